@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+)
+
+var (
+	allowACL       []netip.Prefix
+	denyACL        []netip.Prefix
+	trustedProxies []netip.Prefix
+)
+
+func initACL(allow, deny, trusted string) {
+	allowACL = parsePrefixes(allow)
+	denyACL = parsePrefixes(deny)
+	trustedProxies = parsePrefixes(trusted)
+	if len(allowACL) == 0 {
+		svc.Debug("no allow list, only allow private and loopback clients")
+	}
+}
+
+// allowed reports whether ip may query. Clients in denyACL are denied, and
+// without allowACL only private, loopback and link-local clients are allowed.
+// Unix socket clients, which have no IP address, are always allowed.
+func allowed(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return true
+	}
+	if containsAddr(denyACL, ip) {
+		return false
+	}
+	if len(allowACL) == 0 {
+		return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+	}
+	return containsAddr(allowACL, ip)
+}
+
+// aclHandler answers denied clients with REFUSED, or drops their queries
+// silently with -drop.
+type aclHandler struct {
+	dns.Handler
+}
+
+func (h aclHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	if ip := remoteAddr(w); !allowed(ip) {
+		svc.Debug("denied", "remote", ip, "id", r.ID, "question", r.Question)
+		if !*drop {
+			writeRcode(w, r, dns.RcodeRefused)
+		} else if !isUDP(w) {
+			w.Hijack()
+			w.Close()
+		}
+		return
+	}
+	h.Handler.ServeDNS(ctx, w, r)
+}
+
+// forwardedWriter replaces the remote address of a DoH request behind trusted
+// proxies with the client address from X-Forwarded-For.
+type forwardedWriter struct {
+	dns.ResponseWriter
+	addr net.Addr
+}
+
+func (w *forwardedWriter) RemoteAddr() net.Addr { return w.addr }
+
+// dohClient returns the client address of a DoH request. X-Forwarded-For is
+// only used when the request comes from a trusted proxy or a Unix socket, the
+// client is the last address not of a trusted proxy.
+func dohClient(r *http.Request) (netip.Addr, bool) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err == nil && !containsAddr(trustedProxies, peer.Addr().Unmap()) {
+		return netip.Addr{}, false
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		if ip = ip.Unmap(); !containsAddr(trustedProxies, ip) {
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
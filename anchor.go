@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/sunshineplan/utils/txt"
+)
+
+// addHoldDown is the time a new key must be seen before it is trusted, see
+// RFC 5011 section 2.4.1.
+const addHoldDown = 30 * 24 * time.Hour
+
+// rootAnchors are the DS records of the root KSK-2017 and KSK-2024.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Key states of RFC 5011.
+const (
+	keyValid   = "valid"
+	keyPending = "pending"
+	keyRevoked = "revoked"
+)
+
+type anchorKey struct {
+	key   *dns.DNSKEY
+	state string
+	since time.Time
+}
+
+// trustAnchor is a DS or DNSKEY anchored zone, its keys are kept up to date
+// as RFC 5011 describes.
+type trustAnchor struct {
+	zone string
+	ds   []*dns.DS
+	keys []*anchorKey
+}
+
+var (
+	trustAnchors []*trustAnchor
+	anchorFile   string
+	anchorMu     sync.Mutex
+)
+
+// initTrustAnchors loads the trust anchor file, one DS or DNSKEY record for
+// each line, DNSKEY records may be followed by their RFC 5011 state as
+// comment. Without file the root anchors are used.
+func initTrustAnchors(file string) {
+	anchorFile = file
+	rows := rootAnchors
+	if file != "" {
+		var err error
+		if rows, err = txt.ReadFile(file); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				svc.Error("failed to load trust anchors", "file", file, "error", err)
+			}
+			rows = rootAnchors
+		}
+	}
+	for line, i := range rows {
+		rr, note, _ := strings.Cut(i, ";")
+		if rr = strings.TrimSpace(rr); rr == "" {
+			continue
+		}
+		if err := addTrustAnchor(rr, strings.Fields(note)); err != nil {
+			svc.Error("illegal trust anchor", "file", file, "line", line+1, "row", i, "error", err)
+		}
+	}
+	for _, a := range trustAnchors {
+		svc.Debug("trust anchor", "zone", a.zone, "ds", len(a.ds), "keys", len(a.keys))
+	}
+}
+
+func addTrustAnchor(s string, note []string) error {
+	rr, err := dns.New(s)
+	if err != nil {
+		return err
+	}
+	zone := dnsutil.Canonical(rr.Header().Name)
+	var a *trustAnchor
+	for _, i := range trustAnchors {
+		if i.zone == zone {
+			a = i
+		}
+	}
+	if a == nil {
+		a = &trustAnchor{zone: zone}
+		trustAnchors = append(trustAnchors, a)
+	}
+	switch rr := rr.(type) {
+	case *dns.DS:
+		a.ds = append(a.ds, rr)
+	case *dns.DNSKEY:
+		k := &anchorKey{key: rr, state: keyValid}
+		if len(note) > 0 {
+			k.state = note[0]
+		}
+		if len(note) > 1 {
+			since, err := strconv.ParseInt(note[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			k.since = time.Unix(since, 0)
+		}
+		a.keys = append(a.keys, k)
+	default:
+		return fmt.Errorf("trust anchor must be DS or DNSKEY")
+	}
+	return nil
+}
+
+// closestAnchor returns the trust anchor closest above name.
+func closestAnchor(name string) (anchor *trustAnchor) {
+	for _, a := range trustAnchors {
+		if dnsutil.IsBelow(a.zone, name) && (anchor == nil || dnsutil.Labels(a.zone) > dnsutil.Labels(anchor.zone)) {
+			anchor = a
+		}
+	}
+	return
+}
+
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.PublicKey == b.PublicKey
+}
+
+func (a *trustAnchor) key(k *dns.DNSKEY) *anchorKey {
+	for _, i := range a.keys {
+		if sameKey(i.key, k) {
+			return i
+		}
+	}
+	return nil
+}
+
+// trusted returns the keys of the DNSKEY RRset which are trusted by a.
+func (a *trustAnchor) trusted(keys []*dns.DNSKEY) (res []*dns.DNSKEY) {
+	anchorMu.Lock()
+	defer anchorMu.Unlock()
+	for _, k := range keys {
+		if k.Flags&dns.FlagREVOKE != 0 {
+			continue
+		}
+		if i := a.key(k); i != nil {
+			if i.state == keyValid {
+				res = append(res, k)
+			}
+			continue
+		}
+		if slices.ContainsFunc(a.ds, func(ds *dns.DS) bool { return matchDS(k, ds) }) {
+			res = append(res, k)
+		}
+	}
+	return
+}
+
+// update tracks the SEP keys of the validated DNSKEY RRset of the anchored
+// zone, see RFC 5011 section 4.
+func (a *trustAnchor) update(keys []*dns.DNSKEY, sigs []*dns.RRSIG) {
+	anchorMu.Lock()
+	defer anchorMu.Unlock()
+	now := time.Now()
+	var changed bool
+	for _, k := range keys {
+		if k.Flags&dns.FlagSEP == 0 {
+			continue
+		}
+		i := a.key(k)
+		if k.Flags&dns.FlagREVOKE != 0 {
+			// revoked keys must sign the DNSKEY RRset themselves
+			if i != nil && i.state != keyRevoked && slices.ContainsFunc(sigs, func(sig *dns.RRSIG) bool {
+				return verifySig(sig, k, rrsToRR(keys)) == nil
+			}) {
+				svc.Print("trust anchor revoked ", a.zone, " ", k.KeyTag())
+				i.state, i.since, changed = keyRevoked, now, true
+			}
+			continue
+		}
+		switch {
+		case i == nil:
+			state := keyPending
+			if slices.ContainsFunc(a.ds, func(ds *dns.DS) bool { return matchDS(k, ds) }) {
+				state = keyValid
+			}
+			svc.Print("new trust anchor key ", a.zone, " ", k.KeyTag(), " ", state)
+			a.keys = append(a.keys, &anchorKey{key: k, state: state, since: now})
+			changed = true
+		case i.state == keyPending && now.Sub(i.since) >= addHoldDown:
+			svc.Print("trust anchor key ", a.zone, " ", k.KeyTag(), " becomes valid")
+			i.state, i.since, changed = keyValid, now, true
+		}
+	}
+	// pending keys disappearing from the RRset are forgotten
+	a.keys = slices.DeleteFunc(a.keys, func(i *anchorKey) bool {
+		if i.state == keyPending && !slices.ContainsFunc(keys, func(k *dns.DNSKEY) bool { return sameKey(k, i.key) }) {
+			changed = true
+			return true
+		}
+		return false
+	})
+	if changed {
+		saveTrustAnchors()
+	}
+}
+
+// saveTrustAnchors writes the trust anchors with their key states to the
+// trust anchor file. anchorMu must be held.
+func saveTrustAnchors() {
+	if anchorFile == "" {
+		return
+	}
+	var b strings.Builder
+	for _, a := range trustAnchors {
+		for _, ds := range a.ds {
+			fmt.Fprintln(&b, ds)
+		}
+		for _, k := range a.keys {
+			key := k.key.Clone().(*dns.DNSKEY)
+			key.Hdr.TTL = 0
+			fmt.Fprintf(&b, "%s ; %s %d\n", key, k.state, k.since.Unix())
+		}
+	}
+	if err := os.WriteFile(anchorFile, []byte(b.String()), 0644); err != nil {
+		svc.Error("failed to save trust anchors", "file", anchorFile, "error", err)
+	}
+}
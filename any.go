@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+// anyTTL is the TTL of the synthesized HINFO answer to ANY queries.
+const anyTTL = 3600
+
+// anyHandler answers ANY queries as set by -any: with a single synthesized
+// HINFO record as RFC 8482 suggests, with REFUSED, or forwarded as they are.
+type anyHandler struct {
+	dns.Handler
+}
+
+func (h anyHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 || dns.RRToType(r.Question[0]) != dns.TypeANY {
+		h.Handler.ServeDNS(ctx, w, r)
+		return
+	}
+	switch *anyMode {
+	case "refuse":
+		svc.Debug("refuse ANY query", "remote", w.RemoteAddr(), "question", r.Question)
+		writeRcode(w, r, dns.RcodeRefused)
+	case "forward":
+		h.Handler.ServeDNS(ctx, w, r)
+	default:
+		svc.Debug("minimal ANY answer", "remote", w.RemoteAddr(), "question", r.Question)
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, r)
+		m.RecursionAvailable = true
+		m.Answer = []dns.RR{&dns.HINFO{
+			Hdr:   dns.Header{Name: r.Question[0].Header().Name, Class: r.Question[0].Header().Class, TTL: anyTTL},
+			HINFO: rdata.HINFO{Cpu: "RFC8482"},
+		}}
+		m.WriteTo(w)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/utils/txt"
+)
+
+// arpFile is the ARP table of Linux, MAC addresses of clients are only
+// available on Linux for clients in directly connected IPv4 networks.
+const arpFile = "/proc/net/arp"
+
+// arpInterval is how long the ARP table is kept before read again.
+const arpInterval = 10 * time.Second
+
+var arp struct {
+	sync.Mutex
+	table map[netip.Addr]string
+	read  time.Time
+}
+
+// lookupMAC returns the MAC address of ip from the ARP table.
+func lookupMAC(ip netip.Addr) string {
+	arp.Lock()
+	defer arp.Unlock()
+	if time.Since(arp.read) > arpInterval {
+		arp.table, arp.read = readARP(), time.Now()
+	}
+	return arp.table[ip]
+}
+
+func readARP() map[netip.Addr]string {
+	table := make(map[netip.Addr]string)
+	rows, err := txt.ReadFile(arpFile)
+	if err != nil {
+		svc.Debug("failed to read ARP table", "error", err)
+		return table
+	}
+	// IP address, HW type, Flags, HW address, Mask, Device
+	for _, i := range rows {
+		fields := strings.Fields(i)
+		if len(fields) < 4 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			table[ip] = mac.String()
+		}
+	}
+	return table
+}
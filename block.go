@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// domainSet is a set of domains in canonical form, matching the domains and
+// all names below them.
+type domainSet map[string]bool
+
+// match reports whether name is in s, a nil set as of a list which failed to
+// load matches nothing.
+func (s *domainSet) match(name string) bool {
+	if s == nil || len(*s) == 0 {
+		return false
+	}
+	name = dnsutil.Canonical(name)
+	for off, end := 0, false; !end; off, end = dnsutil.Next(name, off) {
+		if (*s)[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+func loadDomainSet(file string) (domainSet, error) {
+	domains, err := readExcludeList(file)
+	if err != nil {
+		return nil, err
+	}
+	s := make(domainSet)
+	for _, i := range domains {
+		s[dnsutil.Canonical(i)] = true
+	}
+	return s, nil
+}
+
+// initDomainSet loads the domain list file into p and reloads it when
+// changed.
+func initDomainSet(file string, p *atomic.Pointer[domainSet]) {
+	if file == "" {
+		return
+	}
+	load := func() {
+		s, err := loadDomainSet(file)
+		if err != nil {
+			svc.Error("failed to load domain list", "file", file, "error", err)
+			return
+		}
+		p.Store(&s)
+	}
+	load()
+	if err := watchPaths([]string{file}, "", func() {
+		svc.Print("reload domain list ", file)
+		load()
+	}); err != nil {
+		svc.Error("failed to watch domain list", "file", file, "error", err)
+	}
+}
+
+var currentBlock atomic.Pointer[domainSet]
+
+// getBlock answers r with NXDOMAIN when its name is in the blocklist.
+func getBlock(s *domainSet, r *dns.Msg) (*dns.Msg, bool) {
+	if !s.match(r.Question[0].Header().Name) {
+		return nil, false
+	}
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.RecursionAvailable = true
+	m.Rcode = dns.RcodeNameError
+	return m, true
+}
@@ -1,23 +1,93 @@
 package main
 
 import (
-	"fmt"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"time"
 
 	"codeberg.org/miekg/dns"
-	"github.com/sunshineplan/utils/cache"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/sunshineplan/utils/container"
 )
 
-var dnsCache = cache.NewWithRenew[string, *dns.Msg](true)
+// cacheVersion is the version of the cache snapshot format. Snapshots with a
+// different version are ignored on load.
+const cacheVersion = 1
 
-func getCache(key []dns.RR) (*dns.Msg, bool) {
-	if m, ok := dnsCache.Get(fmt.Sprint(key)); ok {
+// staleTTL is the lifecycle and TTL given to expired entries loaded as stale.
+const staleTTL = 30 * time.Second
+
+var dnsCache = new(msgCache)
+
+type cacheItem struct {
+	msg    *dns.Msg
+	expire time.Time
+}
+
+func (i *cacheItem) expired() bool {
+	return !i.expire.IsZero() && time.Now().After(i.expire)
+}
+
+type msgCache struct {
+	m container.Map[string, *cacheItem]
+}
+
+// Get gets message by key and whether message was found and not expired.
+func (c *msgCache) Get(key string) (*dns.Msg, bool) {
+	i, ok := c.m.Load(key)
+	if !ok {
+		return nil, false
+	}
+	if i.expired() {
+		c.m.CompareAndDelete(key, i)
+		return nil, false
+	}
+	return i.msg, true
+}
+
+// Set sets message for a key, a zero lifecycle means never expire.
+func (c *msgCache) Set(key string, m *dns.Msg, lifecycle time.Duration) {
+	i := &cacheItem{msg: m}
+	if lifecycle > 0 {
+		i.expire = time.Now().Add(lifecycle)
+	}
+	c.m.Store(key, i)
+}
+
+// Delete deletes the message for a key.
+func (c *msgCache) Delete(key string) {
+	c.m.Delete(key)
+}
+
+// Clear deletes all messages in cache.
+func (c *msgCache) Clear() {
+	c.m.Clear()
+}
+
+// Sweep deletes all expired messages in cache.
+func (c *msgCache) Sweep() {
+	c.m.Range(func(key string, i *cacheItem) bool {
+		if i.expired() {
+			c.m.CompareAndDelete(key, i)
+		}
+		return true
+	})
+}
+
+func getCache(key string) (*dns.Msg, bool) {
+	if m, ok := dnsCache.Get(key); ok {
 		return m.Copy(), true
 	}
 	return nil, false
 }
 
-func setCache(key []dns.RR, r *dns.Msg) {
+func setCache(key string, r *dns.Msg) {
+	if r.Truncated {
+		return
+	}
 	m := r.Copy()
 	m.ID = 0
 	m.Data = nil
@@ -25,5 +95,152 @@ func setCache(key []dns.RR, r *dns.Msg) {
 	if len(r.Answer) > 0 {
 		lifecycle = time.Duration(max(r.Answer[0].Header().TTL, 300)) * time.Second
 	}
-	dnsCache.Set(fmt.Sprint(key), m, lifecycle, nil)
+	dnsCache.Set(key, m, lifecycle)
+}
+
+// invalidateCache deletes cached messages whose question name is at or below
+// any of the given patterns.
+func invalidateCache(patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	dnsCache.m.Range(func(key string, i *cacheItem) bool {
+		if len(i.msg.Question) == 0 {
+			return true
+		}
+		name := i.msg.Question[0].Header().Name
+		for _, p := range patterns {
+			if dnsutil.IsBelow(dnsutil.Fqdn(p), name) {
+				svc.Debug("invalidate cache", "pattern", p, "name", name)
+				dnsCache.m.CompareAndDelete(key, i)
+				break
+			}
+		}
+		return true
+	})
+}
+
+type cacheSnapshot struct {
+	Version int
+	Entries []cacheRecord
+}
+
+type cacheRecord struct {
+	Key    string
+	Expire time.Time
+	Msg    []byte
+}
+
+func initCache() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			dnsCache.Sweep()
+		}
+	}()
+
+	if *cacheFile == "" {
+		return
+	}
+	if err := loadCache(*cacheFile, *stale); err != nil {
+		svc.Error("failed to load cache file", "error", err)
+	}
+	if *cacheInterval > 0 {
+		go func() {
+			for range time.Tick(*cacheInterval) {
+				if err := saveCache(*cacheFile); err != nil {
+					svc.Error("failed to save cache file", "error", err)
+				}
+			}
+		}()
+	}
+}
+
+func loadCache(file string, stale bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var snapshot cacheSnapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != cacheVersion {
+		svc.Println("ignore cache file with unsupported version:", snapshot.Version)
+		return nil
+	}
+
+	now := time.Now()
+	var n int
+	for _, i := range snapshot.Entries {
+		m := new(dns.Msg)
+		m.Data = i.Msg
+		if err := m.Unpack(); err != nil {
+			svc.Debug("drop cache entry", "key", i.Key, "error", err)
+			continue
+		}
+		m.Data = nil
+		lifecycle := i.Expire.Sub(now)
+		if lifecycle <= 0 {
+			if !stale {
+				continue
+			}
+			lifecycle = staleTTL
+			for rr := range m.RRs() {
+				rr.Header().TTL = min(rr.Header().TTL, uint32(staleTTL/time.Second))
+			}
+		}
+		dnsCache.Set(i.Key, m, lifecycle)
+		n++
+	}
+	svc.Debug("cache loaded", "file", file, "entries", n)
+	return nil
+}
+
+func saveCache(file string) error {
+	snapshot := cacheSnapshot{Version: cacheVersion}
+	dnsCache.m.Range(func(key string, i *cacheItem) bool {
+		if i.expired() {
+			return true
+		}
+		m := i.msg.Copy()
+		m.Data = nil
+		if err := m.Pack(); err != nil {
+			svc.Debug("skip cache entry", "key", key, "error", err)
+			return true
+		}
+		snapshot.Entries = append(snapshot.Entries, cacheRecord{key, i.expire, m.Data})
+		return true
+	})
+
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		return err
+	}
+	svc.Debug("cache saved", "file", file, "entries", len(snapshot.Entries))
+	return nil
+}
+
+func kill() error {
+	if *cacheFile != "" {
+		if err := saveCache(*cacheFile); err != nil {
+			svc.Error("failed to save cache file", "error", err)
+		}
+	}
+	return nil
 }
@@ -4,18 +4,20 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"fmt"
 	"net"
 	"net/http"
-	"net/netip"
+	"slices"
 	"strings"
 
 	"codeberg.org/miekg/dns"
 	"codeberg.org/miekg/dns/dnshttp"
-	"codeberg.org/miekg/dns/dnsutil"
 	"golang.org/x/net/proxy"
 )
 
+// ednsUDPSize is the EDNS0 UDP size of outgoing queries, as recommended by
+// DNS Flag Day 2020.
+const ednsUDPSize = 1232
+
 type Client interface {
 	ExchangeContext(context.Context, *dns.Msg) (*dns.Msg, error)
 	Name() string
@@ -28,6 +30,11 @@ func parseClients(s string) (clients []Client) {
 		}
 		addr, proxyURL := parseProxy(i)
 		addr = strings.ToLower(addr)
+		if addr == "recursive" {
+			svc.Debug("found recursive resolver")
+			clients = append(clients, rootRecursor())
+			continue
+		}
 		if addr, ok := strings.CutSuffix(addr, "@doh"); ok {
 			svc.Debug("found DNS over HTTPS", "address", addr)
 			t := http.DefaultTransport.(*http.Transport).Clone()
@@ -62,6 +69,29 @@ func parseClients(s string) (clients []Client) {
 	return
 }
 
+// upstreamQuery returns a new query of m advertising ednsUDPSize, with the
+// client subnet policy of ctx applied. Requests are not sent themselves, as
+// their buffer belongs to the server's pool.
+func upstreamQuery(ctx context.Context, m *dns.Msg) *dns.Msg {
+	q := &dns.Msg{MsgHeader: m.MsgHeader, Question: m.Question, Extra: m.Extra, Pseudo: m.Pseudo}
+	q.UDPSize = ednsUDPSize
+	// cookies of the client are meant for DNSHub only, see RFC 7873 section 6
+	q.Pseudo = slices.DeleteFunc(slices.Clone(q.Pseudo), func(rr dns.RR) bool {
+		_, ok := rr.(*dns.COOKIE)
+		return ok
+	})
+	withSubnet(ctx, q)
+	return q
+}
+
+// stripEDNS removes the OPT record of the upstream answer m, for clients
+// which did not send one, see RFC 6891 section 7.
+func stripEDNS(m *dns.Msg) {
+	m.UDPSize, m.Version = 0, 0
+	m.Security, m.CompactAnswers, m.Delegation = false, false, false
+	m.Pseudo = nil
+}
+
 type client struct {
 	network string
 	address string
@@ -69,25 +99,36 @@ type client struct {
 	proxy proxy.Dialer
 }
 
-func (c *client) ExchangeContext(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error) {
+func (c *client) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	q := upstreamQuery(ctx, m)
+	r, err := c.exchange(ctx, q, c.network)
+	if err == nil && r.Truncated && c.network == "udp" {
+		svc.Debug("truncated, retry over TCP", "DNS", c.address, "request", m.Question)
+		return c.exchange(ctx, q, "tcp")
+	}
+	return r, err
+}
+
+func (c *client) exchange(ctx context.Context, m *dns.Msg, network string) (r *dns.Msg, err error) {
 	if c.proxy == nil {
 		svc.Debug("direct", "DNS", c.address, "request", m.Question)
-		r, _, err = c.Client.Exchange(ctx, m, c.network, c.address)
+		r, _, err = c.Client.Exchange(ctx, m, network, c.address)
 	} else {
 		var conn net.Conn
 		if d, ok := c.proxy.(proxy.ContextDialer); ok {
-			conn, err = d.DialContext(ctx, c.network, c.address)
+			conn, err = d.DialContext(ctx, network, c.address)
 		} else {
-			conn, err = dialContext(ctx, c.proxy, c.network, c.address)
+			conn, err = dialContext(ctx, c.proxy, network, c.address)
 		}
 		if err != nil {
 			return
 		}
+		defer conn.Close()
 		if c.TLSConfig != nil {
 			conn = tls.Client(conn, c.TLSConfig)
 		}
 		svc.Debug("proxy", "DNS", c.address, "request", m.Question)
-		r, _, err = c.ExchangeWithConn(ctx, r, conn)
+		r, _, err = c.ExchangeWithConn(ctx, m, conn)
 	}
 	return
 }
@@ -102,7 +143,8 @@ type doh struct {
 }
 
 func (c *doh) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
-	req, err := dnshttp.NewRequest(http.MethodPost, "https://"+c.server, m.Copy())
+	m = upstreamQuery(ctx, m)
+	req, err := dnshttp.NewRequest(http.MethodPost, "https://"+c.server, m)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +152,7 @@ func (c *doh) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
 	if err != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 		defer cancel()
-		req, _ := dnshttp.NewRequest(http.MethodPost, "https://"+c.server, m.Copy())
+		req, _ := dnshttp.NewRequest(http.MethodPost, "https://"+c.server, m)
 		var e error
 		if resp, e = http.DefaultClient.Do(req.WithContext(ctx)); e != nil {
 			return nil, err
@@ -131,127 +173,3 @@ func (c *doh) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
 func (c *doh) Name() string {
 	return c.server + "[DoH]"
 }
-
-var defaultResolver = &resolver{net.DefaultResolver}
-
-type resolver struct {
-	*net.Resolver
-}
-
-func (r resolver) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
-	svc.Debug("system DNS", "request", m.Question)
-	m = m.Copy()
-	q := m.Question[0].Header().Name
-	qType := dns.RRToType(m.Question[0])
-	switch qType {
-	case dns.TypeA, dns.TypeAAAA:
-		ips, err := r.LookupIP(ctx, "ip", q)
-		if err != nil {
-			return nil, err
-		}
-		for _, ip := range ips {
-			var s string
-			switch qType {
-			case dns.TypeA:
-				if ip.DefaultMask() != nil {
-					s = fmt.Sprintf("%s A %s", q, ip)
-				}
-			case dns.TypeAAAA:
-				if ip.DefaultMask() == nil {
-					s = fmt.Sprintf("%s AAAA %s", q, ip)
-				}
-			}
-			rr, err := dns.New(s)
-			if err != nil {
-				return nil, err
-			}
-			if rr != nil {
-				m.Answer = append(m.Answer, rr)
-			}
-		}
-	case dns.TypeCNAME:
-		cname, err := r.LookupCNAME(ctx, q)
-		if err != nil {
-			return nil, err
-		}
-		s := fmt.Sprintf("%s CNAME %s", q, cname)
-		rr, err := dns.New(s)
-		if err != nil {
-			return nil, err
-		}
-		m.Answer = append(m.Answer, rr)
-	case dns.TypeTXT:
-		txt, err := r.LookupTXT(ctx, q)
-		if err != nil {
-			return nil, err
-		}
-		for _, i := range txt {
-			s := fmt.Sprintf("%s TXT %q", q, i)
-			rr, err := dns.New(s)
-			if err != nil {
-				return nil, err
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypePTR:
-		addr, err := r.LookupAddr(ctx, q)
-		if err != nil {
-			return nil, err
-		}
-		reverse := dnsutil.ReverseAddr(netip.MustParseAddr(q))
-		for _, i := range addr {
-			s := fmt.Sprintf("%s PTR %s", reverse, i)
-			rr, err := dns.New(s)
-			if err != nil {
-				return nil, err
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeMX:
-		mx, err := r.LookupMX(ctx, q)
-		if err != nil {
-			return nil, err
-		}
-		for _, i := range mx {
-			s := fmt.Sprintf("%s MX %d %s", q, i.Pref, i.Host)
-			rr, err := dns.New(s)
-			if err != nil {
-				return nil, err
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeNS:
-		ns, err := r.LookupNS(ctx, q)
-		if err != nil {
-			return nil, err
-		}
-		for _, i := range ns {
-			s := fmt.Sprintf("%s NS %s", q, i.Host)
-			rr, err := dns.New(s)
-			if err != nil {
-				return nil, err
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	case dns.TypeSRV:
-		_, srv, err := r.LookupSRV(ctx, "", "", q)
-		if err != nil {
-			return nil, err
-		}
-		for _, i := range srv {
-			s := fmt.Sprintf("%s SRV %d %d %d %s", q, i.Priority, i.Weight, i.Port, i.Target)
-			rr, err := dns.New(s)
-			if err != nil {
-				return nil, err
-			}
-			m.Answer = append(m.Answer, rr)
-		}
-	default:
-		return nil, fmt.Errorf("not supported query type for local lookup: %d", qType)
-	}
-	return m, nil
-}
-
-func (resolver) Name() string {
-	return "system"
-}
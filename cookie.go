@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// Server cookies are laid out as RFC 9018 describes, with a truncated
+// HMAC-SHA256 as hash. They are valid for an hour, and the previous secret is
+// still accepted after a rotation.
+const (
+	cookieVersion = 1
+	cookieMaxAge  = time.Hour
+	cookieMaxSkew = 5 * time.Minute
+)
+
+var errBadCookie = errors.New("malformed cookie")
+
+// cookieSecrets holds the current and the previous secret.
+var cookieSecrets atomic.Pointer[[2][]byte]
+
+func initCookie(enable bool, rotate time.Duration) {
+	if !enable {
+		return
+	}
+	svc.Debug("DNS cookies", "rotate", rotate)
+	rotateCookieSecret()
+	if rotate > 0 {
+		go func() {
+			for range time.Tick(rotate) {
+				svc.Debug("rotate cookie secret")
+				rotateCookieSecret()
+			}
+		}()
+	}
+}
+
+func rotateCookieSecret() {
+	var secrets [2][]byte
+	if old := cookieSecrets.Load(); old != nil {
+		secrets[1] = old[0]
+	}
+	secrets[0] = make([]byte, 16)
+	rand.Read(secrets[0])
+	cookieSecrets.Store(&secrets)
+}
+
+// requestCookie returns the client and server cookie of r.
+func requestCookie(r *dns.Msg) (client, server []byte, err error) {
+	if err := r.Unpack(); err != nil {
+		return nil, nil, err
+	}
+	for _, rr := range r.Pseudo {
+		if i, ok := rr.(*dns.COOKIE); ok {
+			b, err := hex.DecodeString(i.Cookie)
+			if err != nil || len(b) < 8 || (len(b) > 8 && len(b) < 16) || len(b) > 40 {
+				return nil, nil, errBadCookie
+			}
+			return b[:8], b[8:], nil
+		}
+	}
+	return
+}
+
+func serverCookie(secret, client []byte, ip netip.Addr, t time.Time) []byte {
+	b := make([]byte, 8, 16)
+	b[0] = cookieVersion
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Unix()))
+	h := hmac.New(sha256.New, secret)
+	h.Write(client)
+	h.Write(b)
+	h.Write(ip.AsSlice())
+	return h.Sum(b)[:16]
+}
+
+func validCookie(client, server []byte, ip netip.Addr) bool {
+	secrets := cookieSecrets.Load()
+	if secrets == nil || len(server) != 16 || server[0] != cookieVersion {
+		return false
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint32(server[4:])), 0)
+	if age := time.Since(t); age > cookieMaxAge || age < -cookieMaxSkew {
+		return false
+	}
+	for _, secret := range secrets {
+		if secret != nil && hmac.Equal(serverCookie(secret, client, ip, t), server) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasValidCookie reports whether r carries a valid server cookie.
+func hasValidCookie(w dns.ResponseWriter, r *dns.Msg) bool {
+	if cookieSecrets.Load() == nil {
+		return false
+	}
+	client, server, err := requestCookie(r)
+	return err == nil && validCookie(client, server, remoteAddr(w))
+}
+
+func newCookie(client []byte, ip netip.Addr) dns.RR {
+	return &dns.COOKIE{Cookie: hex.EncodeToString(slices.Concat(client, serverCookie(cookieSecrets.Load()[0], client, ip, time.Now())))}
+}
+
+// writeBadCookie answers a UDP query having a client cookie with BADCOOKIE
+// and a new server cookie, so that the client can retry with it. It returns
+// false if r has no client cookie.
+func writeBadCookie(w dns.ResponseWriter, r *dns.Msg) bool {
+	if cookieSecrets.Load() == nil || !isUDP(w) {
+		return false
+	}
+	client, _, err := requestCookie(r)
+	if err != nil || client == nil {
+		return false
+	}
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.Rcode = dns.RcodeBadCookie
+	m.UDPSize = uint16(*udpSize)
+	m.Pseudo = []dns.RR{newCookie(client, remoteAddr(w))}
+	m.WriteTo(w)
+	return true
+}
+
+// cookieHandler adds a server cookie to the responses to UDP queries having
+// a client cookie, see RFC 7873. Queries with malformed cookies are answered
+// with FORMERR.
+type cookieHandler struct {
+	dns.Handler
+}
+
+func (h cookieHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	if cookieSecrets.Load() == nil || !isUDP(w) {
+		h.Handler.ServeDNS(ctx, w, r)
+		return
+	}
+	client, _, err := requestCookie(r)
+	if err == errBadCookie {
+		svc.Debug("malformed cookie", "remote", w.RemoteAddr(), "id", r.ID)
+		writeRcode(w, r, dns.RcodeFormatError)
+		return
+	} else if err != nil || client == nil {
+		h.Handler.ServeDNS(ctx, w, r)
+		return
+	}
+	cookie := newCookie(client, remoteAddr(w))
+	h.Handler.ServeDNS(ctx, &udpWriter{w, func(p []byte) []byte {
+		m := &dns.Msg{Data: p}
+		if err := m.Unpack(); err != nil {
+			return p
+		}
+		m.Pseudo = slices.DeleteFunc(m.Pseudo, func(rr dns.RR) bool {
+			_, ok := rr.(*dns.COOKIE)
+			return ok
+		})
+		m.Pseudo = append(m.Pseudo, cookie)
+		if m.UDPSize == 0 {
+			m.UDPSize = uint16(*udpSize)
+		}
+		m.Data = nil
+		if err := m.Pack(); err != nil {
+			return p
+		}
+		return m.Data
+	}}, r)
+}
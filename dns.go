@@ -7,6 +7,7 @@ import (
 	"codeberg.org/miekg/dns"
 	"codeberg.org/miekg/dns/dnsutil"
 	"github.com/sunshineplan/workers/executor"
+	"golang.org/x/sync/singleflight"
 )
 
 type Result struct {
@@ -31,41 +32,195 @@ func ExchangeContext(ctx context.Context, r *dns.Msg, clients ...Client) (*Resul
 	)
 }
 
-func initHandle(primary, backup []Client) {
-	dns.DefaultServeMux.HandleFunc(".", func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
-		id := r.ID
-		svc.Debug("request", "local", w.LocalAddr(), "remote", w.RemoteAddr(), "id", id, "question", r.Question)
-		if m, ok := getCache(r.Question); ok {
-			svc.Debug("cached", "question", r.Question, "result", m)
-			m.ID = id
-			m.WriteTo(w)
-			return
-		}
-		c, cancel := context.WithTimeout(ctx, *timeout)
-		defer cancel()
-		m, err := ExchangeContext(c, r, primary...)
-		if err != nil {
-			svc.Error("request failed", "error", err)
-			if *fallback {
+// inflight coalesces identical cache-miss queries into one upstream exchange.
+var inflight singleflight.Group
+
+func resolve(ctx context.Context, r *dns.Msg, first, second []Client, kind string) (m *Result, err error) {
+	c, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	if m, err = ExchangeContext(c, r, first...); err != nil {
+		svc.Error("request"+kind+" failed", "error", err)
+		if *fallback {
+			c, cancel := context.WithTimeout(ctx, *timeout)
+			defer cancel()
+			if m, err = ExchangeContext(c, r, second...); err != nil {
+				svc.Error("fallback request"+kind+" failed", "error", err)
 				c, cancel := context.WithTimeout(ctx, *timeout)
 				defer cancel()
-				if m, err = ExchangeContext(c, r, backup...); err != nil {
-					svc.Error("fallback backup request failed", "error", err)
-					c, cancel := context.WithTimeout(ctx, *timeout)
-					defer cancel()
-					if m, err = ExchangeContext(c, r, defaultResolver); err != nil {
-						svc.Error("fallback system request failed", "error", err)
-					}
+				if m, err = ExchangeContext(c, r, defaultResolver); err != nil {
+					svc.Error("fallback system request"+kind+" failed", "error", err)
 				}
 			}
 		}
+	}
+	return
+}
+
+// writeRcode writes an empty reply to r with rcode.
+func writeRcode(w dns.ResponseWriter, r *dns.Msg, rcode uint16) {
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.Rcode = rcode
+	m.WriteTo(w)
+}
+
+func serve(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, first, second []Client, kind string) {
+	id := r.ID
+	svc.Debug("request"+kind, "local", w.LocalAddr(), "remote", w.RemoteAddr(), "id", id, "question", r.Question)
+	if r.Opcode != dns.OpcodeQuery {
+		// NOTIFY and UPDATE are only accepted for local zones
+		svc.Debug("unsupported opcode", "question", r.Question, "opcode", dnsutil.OpcodeToString(r.Opcode))
+		writeRcode(w, r, dns.RcodeNotImplemented)
+		return
+	}
+	if r.Question[0].Header().Class != dns.ClassINET {
+		svc.Debug("refuse class", "question", r.Question)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	if t := dns.RRToType(r.Question[0]); t == dns.TypeAXFR || t == dns.TypeIXFR {
+		svc.Debug("refuse zone transfer", "question", r.Question)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	ctx = withClient(ctx, w, r)
+	v := clientView(ctx, w)
+	if v != defaultView {
+		exclude := kind == " exclude"
+		if v.exclude != nil {
+			exclude = v.exclude.Load().match(r.Question[0].Header().Name)
+		}
+		first, second, kind = v.primary, v.backup, " "+v.name
+		if exclude {
+			first, second, kind = second, first, kind+" exclude"
+		}
+		svc.Debug("view", "name", v.name, "remote", w.RemoteAddr(), "id", id)
+	}
+	lookup := func(r *dns.Msg) (*dns.Msg, error) {
+		if m, ok := getHosts(v.hosts.Load(), r); ok {
+			svc.Debug("hosts", "question", r.Question, "result", m)
+			return m, nil
+		}
+		return forward(ctx, r, v, first, second, kind)
+	}
+	rules := getRewrite(v.rewrite)
+	answer := func(r *dns.Msg) (*dns.Msg, error) {
+		if m, ok := getHosts(v.hosts.Load(), r); ok {
+			svc.Debug("hosts", "question", r.Question, "result", m)
+			return m, nil
+		}
+		if m, ok := getBlock(v.block.Load(), r); ok {
+			svc.Debug("blocked", "question", r.Question)
+			return m, nil
+		}
+		m, err := rules.query(r, lookup)
+		if err != nil {
+			return nil, err
+		}
+		return rules.answer(r, m), nil
+	}
+	m, err := v.dns64.lookup(r, answer)
+	if err != nil {
+		return
+	}
+	if r.UDPSize == 0 {
+		stripEDNS(m)
+	}
+	m.ID = id
+	m.Data = nil
+	m.WriteTo(w)
+}
+
+// forward answers r from cache or upstream DNS.
+func forward(ctx context.Context, r *dns.Msg, v *view, first, second []Client, kind string) (*dns.Msg, error) {
+	key := v.cacheKey(r.Question)
+	subnet := groupECS(first).prefix(ctx)
+	if m, ok := getECSCache(key, subnet); ok {
+		svc.Debug("cached", "question", r.Question, "result", m)
+		if *dnssec {
+			m = dnssecReply(r, m)
+		}
+		return ecsReply(ctx, m), nil
+	}
+	flight := key
+	if subnet.IsValid() {
+		flight += "/" + subnet.String()
+	}
+	res, err, shared := inflight.Do(flight, func() (any, error) {
+		// the exchange is shared by every waiter, so it must not end with the
+		// request of the first one, each exchange in it is still bounded by
+		// -timeout
+		ctx := context.WithoutCancel(ctx)
+		lookup := func(t uint16) (*dns.Msg, error) {
+			hdr := r.Question[0].Header()
+			q := &dns.Msg{MsgHeader: r.MsgHeader, Question: []dns.RR{dns.TypeToRR[t]()}, Pseudo: r.Pseudo}
+			*q.Question[0].Header() = dns.Header{Name: hdr.Name, Class: hdr.Class}
+			return forward(ctx, q, v, first, second, kind)
+		}
+		if *dnssec {
+			m, bogus, err := resolveSecure(ctx, r, first, second, kind)
+			if err == nil && !bogus {
+				m.msg = currentSpeedCheck.check(ctx, r, filterFamily(r, m.msg, lookup), lookup)
+				setCache(ecsCacheKey(key, m.msg), m.msg)
+			}
+			return m, err
+		}
+		m, err := resolve(ctx, r, first, second, kind)
 		if err != nil {
-			return
+			return nil, err
 		}
 		svc.Debug("uncached", "DNS", m.name, "question", r.Question, "result", m.msg)
-		setCache(r.Question, m.msg)
-		m.msg.ID = id
-		m.msg.WriteTo(w)
+		m.msg = currentSpeedCheck.check(ctx, r, filterFamily(r, m.msg, lookup), lookup)
+		setCache(ecsCacheKey(key, m.msg), m.msg)
+		return m, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		svc.Debug("shared", "question", r.Question, "id", r.ID)
+	}
+	m := res.(*Result).msg.Copy()
+	if *dnssec {
+		m = dnssecReply(r, m)
+	}
+	return ecsReply(ctx, m), nil
+}
+
+// resolveSecure resolves r with DNSSEC validation. Answers failing validation
+// are turned into SERVFAIL and reported as bogus.
+func resolveSecure(ctx context.Context, r *dns.Msg, first, second []Client, kind string) (*Result, bool, error) {
+	exchange := func(q *dns.Msg) (*dns.Msg, error) {
+		m, err := resolve(ctx, q, first, second, kind)
+		if err != nil {
+			return nil, err
+		}
+		return m.msg, nil
+	}
+	q := dnssecQuery(r.Question[0].Header().Name, dns.RRToType(r.Question[0]))
+	q.Question = r.Question
+	m, err := resolve(ctx, q, first, second, kind)
+	if err != nil {
+		return nil, false, err
+	}
+	secure, err := validate(ctx, r, m.msg, exchange)
+	if err != nil {
+		svc.Println("DNSSEC validation of", r.Question, "failed:", err)
+		fail := new(dns.Msg)
+		dnsutil.SetReply(fail, r)
+		fail.RecursionAvailable = true
+		fail.Rcode = dns.RcodeServerFailure
+		return &Result{fail, m.name}, true, nil
+	}
+	svc.Debug("uncached", "DNS", m.name, "question", r.Question, "secure", secure, "result", m.msg)
+	m.msg.AuthenticatedData = secure
+	m.msg.Data = nil
+	return m, false, nil
+}
+
+func initHandle(primary, backup []Client) {
+	dns.DefaultServeMux.HandleFunc(".", func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+		serve(ctx, w, r, primary, backup, "")
 	})
 }
 
@@ -78,39 +233,7 @@ func registerExclude(old, new []string, primary, backup []Client) {
 	for _, i := range new {
 		svc.Debug("add", "pattern", i)
 		dns.DefaultServeMux.HandleFunc(dnsutil.Fqdn(i), func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
-			id := r.ID
-			svc.Debug("request exclude", "local", w.LocalAddr(), "remote", w.RemoteAddr(), "id", id, "question", r.Question)
-			if m, ok := getCache(r.Question); ok {
-				svc.Debug("cached", "question", r.Question, "result", m)
-				m.ID = id
-				m.WriteTo(w)
-				return
-			}
-			c, cancel := context.WithTimeout(ctx, *timeout)
-			defer cancel()
-			m, err := ExchangeContext(c, r, backup...)
-			if err != nil {
-				svc.Error("request exclude failed", "error", err)
-				if *fallback {
-					c, cancel := context.WithTimeout(ctx, *timeout)
-					defer cancel()
-					if m, err = ExchangeContext(c, r, primary...); err != nil {
-						svc.Error("fallback primary request exclude failed", "error", err)
-						c, cancel := context.WithTimeout(ctx, *timeout)
-						defer cancel()
-						if m, err = ExchangeContext(c, r, defaultResolver); err != nil {
-							svc.Error("fallback system request exclude failed", "error", err)
-						}
-					}
-				}
-			}
-			if err != nil {
-				return
-			}
-			svc.Debug("uncached", "DNS", m.name, "question", r.Question, "result", m.msg)
-			setCache(r.Question, m.msg)
-			m.msg.ID = id
-			m.msg.WriteTo(w)
+			serve(ctx, w, r, backup, primary, " exclude")
 		})
 	}
 }
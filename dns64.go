@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+var (
+	// wellKnownPrefix is the NAT64 prefix of RFC 6052, which must not be used
+	// for non-global IPv4 addresses.
+	wellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+	sharedAddress   = netip.MustParsePrefix("100.64.0.0/10")
+	// specialAddress are the IPv4 special-purpose ranges of RFC 6890 which
+	// are not global, besides private, shared, loopback and link-local ones.
+	specialAddress = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("192.0.0.0/24"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("198.18.0.0/15"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("240.0.0.0/4"),
+	}
+)
+
+// dns64Config synthesizes AAAA records from A records with a /96 NAT64
+// prefix, see RFC 6147.
+type dns64Config struct {
+	prefix  netip.Prefix
+	exclude []netip.Prefix
+}
+
+var currentDNS64 *dns64Config
+
+func parseDNS64(prefix, exclude string) (*dns64Config, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Addr().Is6() || p.Addr().Is4In6() || p.Bits() != 96 {
+		return nil, errors.New("DNS64 prefix must be an IPv6 /96 prefix")
+	}
+	return &dns64Config{prefix: p.Masked(), exclude: parsePrefixes(exclude)}, nil
+}
+
+func initDNS64(enable bool, prefix, exclude string) {
+	if !enable {
+		return
+	}
+	c, err := parseDNS64(prefix, exclude)
+	if err != nil {
+		svc.Error("illegal DNS64 prefix", "prefix", prefix, "error", err)
+		return
+	}
+	svc.Debug("DNS64", "prefix", c.prefix, "exclude", c.exclude)
+	currentDNS64, defaultView.dns64 = c, c
+}
+
+// synthesizable reports whether an AAAA record may be synthesized from ip.
+func (c *dns64Config) synthesizable(ip netip.Addr) bool {
+	if containsAddr(c.exclude, ip) {
+		return false
+	}
+	if c.prefix == wellKnownPrefix {
+		return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddress.Contains(ip) && !containsAddr(specialAddress, ip)
+	}
+	return true
+}
+
+func (c *dns64Config) embed(ip netip.Addr) netip.Addr {
+	b := c.prefix.Addr().As16()
+	v4 := ip.As4()
+	copy(b[12:], v4[:])
+	return netip.AddrFrom16(b)
+}
+
+// lookup resolves r with DNS64 applied. AAAA queries without AAAA records
+// are answered with records synthesized from the A records of the name, and
+// PTR queries of synthesized addresses are answered by a CNAME to the
+// in-addr.arpa name. Validating clients setting CD and DO are not affected.
+func (c *dns64Config) lookup(r *dns.Msg, lookup func(*dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	if c == nil || (r.CheckingDisabled && r.Security) {
+		return lookup(r)
+	}
+	q := r.Question[0]
+	switch dns.RRToType(q) {
+	case dns.TypePTR:
+		if name := dnsutil.Canonical(q.Header().Name); dnsutil.IsReverse(name) == dnsutil.IPv6Family {
+			if ip := dnsutil.AddrReverse(name); ip.IsValid() && c.prefix.Contains(ip) {
+				return c.reverse(r, ip, lookup)
+			}
+		}
+	case dns.TypeAAAA:
+		m, err := lookup(r)
+		if err != nil || m.Rcode != dns.RcodeSuccess || hasAAAA(m.Answer) {
+			return m, err
+		}
+		if res := c.synthesize(r, m, lookup); res != nil {
+			return res, nil
+		}
+		return m, nil
+	}
+	return lookup(r)
+}
+
+// hasAAAA reports whether rrs has AAAA records, IPv4-mapped addresses are
+// treated as nonexistent.
+func hasAAAA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr, ok := rr.(*dns.AAAA); ok && !rr.Addr.Is4In6() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *dns64Config) synthesize(r, m *dns.Msg, lookup func(*dns.Msg) (*dns.Msg, error)) *dns.Msg {
+	hdr := r.Question[0].Header()
+	a := &dns.Msg{MsgHeader: r.MsgHeader, Question: []dns.RR{&dns.A{Hdr: dns.Header{Name: hdr.Name, Class: hdr.Class}}}, Pseudo: r.Pseudo}
+	am, err := lookup(a)
+	if err != nil || am.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	// the TTL is capped by the negative caching TTL of the AAAA answer
+	maxTTL := ^uint32(0)
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			maxTTL = min(soa.Hdr.TTL, soa.Minttl)
+		}
+	}
+	res := new(dns.Msg)
+	dnsutil.SetReply(res, r)
+	res.RecursionAvailable = true
+	var synthesized bool
+	for _, rr := range am.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			res.Answer = append(res.Answer, rr)
+		case *dns.A:
+			if !c.synthesizable(rr.Addr) {
+				continue
+			}
+			h := rr.Hdr
+			h.TTL = min(h.TTL, maxTTL)
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: h, AAAA: rdata.AAAA{Addr: c.embed(rr.Addr)}})
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return nil
+	}
+	svc.Debug("DNS64", "question", r.Question, "answer", res.Answer)
+	return res
+}
+
+func (c *dns64Config) reverse(r *dns.Msg, ip netip.Addr, lookup func(*dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	b := ip.As16()
+	target := dnsutil.ReverseAddr(netip.AddrFrom4([4]byte(b[12:])))
+	hdr := r.Question[0].Header()
+	ptr := &dns.Msg{MsgHeader: r.MsgHeader, Question: []dns.RR{&dns.PTR{Hdr: dns.Header{Name: target, Class: hdr.Class}}}, Pseudo: r.Pseudo}
+	pm, err := lookup(ptr)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.RecursionAvailable = true
+	m.Rcode = pm.Rcode
+	cname := &dns.CNAME{Hdr: dns.Header{Name: hdr.Name, Class: hdr.Class}, CNAME: rdata.CNAME{Target: target}}
+	if len(pm.Answer) > 0 {
+		cname.Hdr.TTL = pm.Answer[0].Header().TTL
+	}
+	m.Answer = append([]dns.RR{cname}, pm.Answer...)
+	m.Ns = pm.Ns
+	svc.Debug("DNS64 reverse", "question", r.Question, "target", target)
+	return m, nil
+}
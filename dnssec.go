@@ -0,0 +1,700 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+const (
+	// maxChainTTL caps the time validated keys are cached.
+	maxChainTTL = time.Hour
+	// maxNSEC3Iterations is the limit above which NSEC3 records are treated as
+	// insecure, see RFC 9276.
+	maxNSEC3Iterations = 150
+)
+
+var errBogus = errors.New("bogus")
+
+func bogus(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", errBogus, fmt.Sprintf(format, a...))
+}
+
+// exchangeFunc sends a query to the upstream DNS.
+type exchangeFunc func(*dns.Msg) (*dns.Msg, error)
+
+// zoneSecurity is the state of the deepest zone enclosing a name, keys is nil
+// when the zone is insecure.
+type zoneSecurity struct {
+	zone   string
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+var (
+	chainMu    sync.Mutex
+	chainCache = make(map[string]*zoneSecurity)
+)
+
+func initDNSSEC(enable bool, anchors string) {
+	if !enable {
+		return
+	}
+	initTrustAnchors(anchors)
+	go func() {
+		for range time.Tick(maxChainTTL) {
+			now := time.Now()
+			chainMu.Lock()
+			for name, s := range chainCache {
+				if now.After(s.expire) {
+					delete(chainCache, name)
+				}
+			}
+			chainMu.Unlock()
+		}
+	}()
+}
+
+func cachedSecurity(name string) *zoneSecurity {
+	chainMu.Lock()
+	defer chainMu.Unlock()
+	if s, ok := chainCache[name]; ok && time.Now().Before(s.expire) {
+		return s
+	}
+	return nil
+}
+
+func storeSecurity(name string, s *zoneSecurity) {
+	chainMu.Lock()
+	chainCache[name] = s
+	chainMu.Unlock()
+}
+
+func chainExpire(ttl uint32) time.Time {
+	return time.Now().Add(min(time.Duration(ttl)*time.Second, maxChainTTL))
+}
+
+// dnssecQuery returns a query for name and t with the DO and CD bits set, so
+// that the upstream DNS returns signatures and leaves validation to us.
+func dnssecQuery(name string, t uint16) *dns.Msg {
+	m := dns.NewMsg(name, t)
+	m.Security = true
+	m.CheckingDisabled = true
+	m.UDPSize = ednsUDPSize
+	return m
+}
+
+// rrset is a set of records of the same name and type with their signatures.
+type rrset struct {
+	name string
+	t    uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+func rrsets(rrs []dns.RR) (sets []*rrset) {
+	get := func(name string, t uint16) *rrset {
+		for _, i := range sets {
+			if i.name == name && i.t == t {
+				return i
+			}
+		}
+		set := &rrset{name: name, t: t}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range rrs {
+		name := dnsutil.Canonical(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			set := get(name, sig.TypeCovered)
+			set.sigs = append(set.sigs, sig)
+		} else {
+			set := get(name, dns.RRToType(rr))
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// signatures without records are of no use
+	var res []*rrset
+	for _, i := range sets {
+		if len(i.rrs) > 0 {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+func findRRset(sets []*rrset, name string, t uint16) *rrset {
+	for _, i := range sets {
+		if i.name == name && i.t == t {
+			return i
+		}
+	}
+	return nil
+}
+
+func matchDS(k *dns.DNSKEY, ds *dns.DS) bool {
+	if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+		return false
+	}
+	d := k.ToDS(ds.DigestType)
+	return d != nil && strings.EqualFold(d.Digest, ds.Digest)
+}
+
+// verifySig verifies sig over rrs with k. sig is copied as verification
+// modifies it and it may be shared with the cache.
+func verifySig(sig *dns.RRSIG, k *dns.DNSKEY, rrs []dns.RR) error {
+	if !sig.ValidPeriod(time.Time{}) {
+		return errors.New("signature expired")
+	}
+	return sig.Clone().(*dns.RRSIG).Verify(k, rrs, &dns.SignOption{})
+}
+
+// verifyRRset checks set is signed by one of keys of zone.
+func verifyRRset(set *rrset, zone string, keys []*dns.DNSKEY) error {
+	if len(set.sigs) == 0 {
+		return bogus("no signature for %s %s", set.name, dnsutil.TypeToString(set.t))
+	}
+	var err error
+	for _, sig := range set.sigs {
+		if dnsutil.Canonical(sig.SignerName) != zone {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err = verifySig(sig, k, set.rrs); err == nil {
+				return nil
+			}
+		}
+	}
+	if err == nil {
+		err = errors.New("no matching key")
+	}
+	return bogus("%s %s: %v", set.name, dnsutil.TypeToString(set.t), err)
+}
+
+// security returns the state of the deepest zone enclosing name, building
+// the chain of trust down from the closest trust anchor.
+func security(ctx context.Context, name string, exchange exchangeFunc) (*zoneSecurity, error) {
+	name = dnsutil.Canonical(name)
+	if s := cachedSecurity(name); s != nil {
+		return s, nil
+	}
+	anchor := closestAnchor(name)
+	if anchor == nil {
+		return &zoneSecurity{zone: "."}, nil
+	}
+	cur, err := anchorSecurity(anchor, exchange)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for off, end := 0, false; !end; off, end = dnsutil.Next(name, off) {
+		if name[off:] == anchor.zone {
+			break
+		}
+		names = append(names, name[off:])
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		child := names[i]
+		if s := cachedSecurity(child); s != nil {
+			cur = s
+		} else {
+			s, stop, err := delegation(cur, child, exchange)
+			if err != nil {
+				return nil, err
+			}
+			storeSecurity(child, s)
+			if cur = s; stop {
+				break
+			}
+		}
+		if cur.keys == nil {
+			break
+		}
+	}
+	return cur, nil
+}
+
+// anchorSecurity validates the DNSKEY RRset of the anchored zone with the
+// trust anchor.
+func anchorSecurity(anchor *trustAnchor, exchange exchangeFunc) (*zoneSecurity, error) {
+	if s := cachedSecurity(anchor.zone); s != nil {
+		return s, nil
+	}
+	m, err := exchange(dnssecQuery(anchor.zone, dns.TypeDNSKEY))
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(rrsets(m.Answer), anchor.zone, dns.TypeDNSKEY)
+	if set == nil {
+		return nil, bogus("no DNSKEY for trust anchor %s", anchor.zone)
+	}
+	keys := dnskeys(set.rrs)
+	if err := verifyRRset(set, anchor.zone, anchor.trusted(keys)); err != nil {
+		return nil, err
+	}
+	anchor.update(keys, set.sigs)
+	s := &zoneSecurity{zone: anchor.zone, keys: keys, expire: chainExpire(set.rrs[0].Header().TTL)}
+	storeSecurity(anchor.zone, s)
+	return s, nil
+}
+
+func dnskeys(rrs []dns.RR) (keys []*dns.DNSKEY) {
+	for _, rr := range rrs {
+		if k, ok := rr.(*dns.DNSKEY); ok && k.Flags&dns.FlagZONE != 0 {
+			keys = append(keys, k)
+		}
+	}
+	return
+}
+
+// delegation looks up the DS of child in the zone of cur. It returns the
+// state of the zone enclosing child, and stop when child does not exist.
+func delegation(cur *zoneSecurity, child string, exchange exchangeFunc) (*zoneSecurity, bool, error) {
+	m, err := exchange(dnssecQuery(child, dns.TypeDS))
+	if err != nil {
+		return nil, false, err
+	}
+	answer := rrsets(m.Answer)
+	if set := findRRset(answer, child, dns.TypeDS); set != nil {
+		if err := verifyRRset(set, cur.zone, cur.keys); err != nil {
+			return nil, false, err
+		}
+		return childSecurity(child, set, exchange)
+	}
+	if findRRset(answer, child, dns.TypeCNAME) != nil {
+		// an alias is no zone cut
+		return cur, true, nil
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return nil, false, fmt.Errorf("DS lookup of %s failed: %s", child, dnsutil.RcodeToString(m.Rcode))
+	}
+	// the absence of DS must be proved by the zone of cur
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, set := range rrsets(m.Ns) {
+		if err := verifyRRset(set, cur.zone, cur.keys); err != nil {
+			return nil, false, err
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, rr)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, rr)
+			}
+		}
+	}
+	if len(nsec) == 0 && len(nsec3) == 0 {
+		return nil, false, bogus("no proof of missing DS for %s", child)
+	}
+	if m.Rcode == dns.RcodeNameError {
+		return cur, true, nil
+	}
+	if insecureDelegation(child, nsec, nsec3) {
+		svc.Debug("insecure delegation", "zone", child)
+		return &zoneSecurity{zone: child, expire: cur.expire}, false, nil
+	}
+	return cur, false, nil
+}
+
+// childSecurity validates the DNSKEY RRset of the zone child with its DS
+// RRset.
+func childSecurity(child string, ds *rrset, exchange exchangeFunc) (*zoneSecurity, bool, error) {
+	var supported []*dns.DS
+	for _, rr := range ds.rrs {
+		if i, ok := rr.(*dns.DS); ok && supportedAlgorithm(i.Algorithm) && (&dns.DNSKEY{}).ToDS(i.DigestType) != nil {
+			supported = append(supported, i)
+		}
+	}
+	if len(supported) == 0 {
+		// zones signed only with unknown algorithms are treated as insecure
+		return &zoneSecurity{zone: child, expire: chainExpire(ds.rrs[0].Header().TTL)}, false, nil
+	}
+	m, err := exchange(dnssecQuery(child, dns.TypeDNSKEY))
+	if err != nil {
+		return nil, false, err
+	}
+	set := findRRset(rrsets(m.Answer), child, dns.TypeDNSKEY)
+	if set == nil {
+		return nil, false, bogus("no DNSKEY for %s", child)
+	}
+	keys := dnskeys(set.rrs)
+	var trusted []*dns.DNSKEY
+	for _, k := range keys {
+		for _, i := range supported {
+			if matchDS(k, i) {
+				trusted = append(trusted, k)
+				break
+			}
+		}
+	}
+	if err := verifyRRset(set, child, trusted); err != nil {
+		return nil, false, err
+	}
+	ttl := min(ds.rrs[0].Header().TTL, set.rrs[0].Header().TTL)
+	return &zoneSecurity{zone: child, keys: keys, expire: chainExpire(ttl)}, false, nil
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// insecureDelegation reports whether the NSEC or NSEC3 records prove child is
+// a delegation without DS.
+func insecureDelegation(child string, nsec []*dns.NSEC, nsec3 []*dns.NSEC3) bool {
+	for _, i := range nsec {
+		if dnsutil.Canonical(i.Hdr.Name) == child {
+			return hasType(i.TypeBitMap, dns.TypeNS) && !hasType(i.TypeBitMap, dns.TypeSOA)
+		}
+	}
+	for _, i := range nsec3 {
+		if nsec3Match(i, child) {
+			return hasType(i.TypeBitMap, dns.TypeNS) && !hasType(i.TypeBitMap, dns.TypeSOA)
+		}
+	}
+	for _, i := range nsec3 {
+		if nsec3Covers(i, child) && i.Flags&1 != 0 {
+			// opt-out span may hold unsigned delegations
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, i := range bitmap {
+		if i == t {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls between the owner and next name of
+// nsec.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if dns.CompareName(owner, name) >= 0 {
+		return false
+	}
+	// the last NSEC of a zone points back to the apex
+	return dns.CompareName(next, owner) <= 0 || dns.CompareName(name, next) < 0
+}
+
+func nsec3Hash(i *dns.NSEC3, name string) string {
+	return dnsutil.NSEC3Name(dnsutil.Canonical(name), i.Salt, i.Iterations)
+}
+
+func nsec3Owner(i *dns.NSEC3) string {
+	label, _, _ := strings.Cut(i.Hdr.Name, ".")
+	return strings.ToUpper(label)
+}
+
+func nsec3Match(i *dns.NSEC3, name string) bool {
+	return nsec3Owner(i) == nsec3Hash(i, name)
+}
+
+func nsec3Covers(i *dns.NSEC3, name string) bool {
+	owner, next, hash := nsec3Owner(i), strings.ToUpper(i.NextDomain), nsec3Hash(i, name)
+	if next <= owner {
+		return hash > owner || hash < next
+	}
+	return owner < hash && hash < next
+}
+
+// ancestors returns name and the names above it.
+func ancestors(name string) (names []string) {
+	for off, end := 0, false; !end; off, end = dnsutil.Next(name, off) {
+		names = append(names, name[off:])
+	}
+	return append(names, ".")
+}
+
+// denied reports whether the NSEC or NSEC3 records prove that name has no
+// records of type t, or does not exist at all with nxdomain.
+func denied(name string, t uint16, nxdomain bool, nsec []*dns.NSEC, nsec3 []*dns.NSEC3) bool {
+	lacks := func(bitmap []uint16) bool { return !hasType(bitmap, t) && !hasType(bitmap, dns.TypeCNAME) }
+	if len(nsec) > 0 {
+		if !nxdomain {
+			for _, i := range nsec {
+				if dnsutil.Canonical(i.Hdr.Name) == name {
+					return lacks(i.TypeBitMap)
+				}
+				// an empty non-terminal has names below it
+				if nsecCovers(i, name) && dnsutil.IsBelow(name, dnsutil.Canonical(i.NextDomain)) {
+					return true
+				}
+			}
+		}
+		// name does not exist, and neither does a wildcard matching it
+		var ce string
+		for _, i := range nsec {
+			if nsecCovers(i, name) {
+				for _, anc := range ancestors(name)[1:] {
+					if dnsutil.IsBelow(anc, dnsutil.Canonical(i.Hdr.Name)) || dnsutil.IsBelow(anc, dnsutil.Canonical(i.NextDomain)) {
+						ce = anc
+						break
+					}
+				}
+				break
+			}
+		}
+		if ce == "" {
+			return false
+		}
+		wildcard := "*." + strings.TrimPrefix(ce, ".")
+		for _, i := range nsec {
+			if nxdomain && nsecCovers(i, wildcard) {
+				return true
+			}
+			if !nxdomain && dnsutil.Canonical(i.Hdr.Name) == wildcard {
+				return lacks(i.TypeBitMap)
+			}
+		}
+		return false
+	}
+
+	if !nxdomain {
+		for _, i := range nsec3 {
+			if nsec3Match(i, name) {
+				return lacks(i.TypeBitMap)
+			}
+		}
+	}
+	// closest encloser proof, see RFC 5155 section 8.3
+	names := ancestors(name)
+	var ce, nc string
+	for n := 1; n < len(names) && ce == ""; n++ {
+		for _, i := range nsec3 {
+			if nsec3Match(i, names[n]) {
+				ce, nc = names[n], names[n-1]
+				break
+			}
+		}
+	}
+	if ce == "" {
+		return false
+	}
+	var optOut bool
+	covered := false
+	for _, i := range nsec3 {
+		if nsec3Covers(i, nc) {
+			covered, optOut = true, i.Flags&1 != 0
+			break
+		}
+	}
+	if !covered {
+		return false
+	}
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	for _, i := range nsec3 {
+		if nxdomain && nsec3Covers(i, wildcard) {
+			return true
+		}
+		if !nxdomain && nsec3Match(i, wildcard) {
+			return lacks(i.TypeBitMap)
+		}
+	}
+	return !nxdomain && t == dns.TypeDS && optOut
+}
+
+// validate validates m, the upstream answer to r, see RFC 4035 section 5.
+// It reports whether all records of the answer and authority section are
+// secure, or returns an error wrapping errBogus.
+func validate(ctx context.Context, r, m *dns.Msg, exchange exchangeFunc) (bool, error) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+	// verify checks set is signed by the zone it belongs to
+	verify := func(set *rrset) (bool, error) {
+		if len(set.sigs) == 0 {
+			s, err := security(ctx, set.name, exchange)
+			if err != nil {
+				return false, err
+			}
+			if s.keys != nil {
+				return false, bogus("no signature for %s %s", set.name, dnsutil.TypeToString(set.t))
+			}
+			return false, nil
+		}
+		signer := dnsutil.Canonical(set.sigs[0].SignerName)
+		if !dnsutil.IsBelow(signer, set.name) {
+			return false, bogus("signer %s of %s is not above it", signer, set.name)
+		}
+		s, err := security(ctx, signer, exchange)
+		if err != nil {
+			return false, err
+		}
+		if s.keys == nil {
+			return false, nil
+		}
+		if s.zone != signer {
+			return false, bogus("signer %s of %s is not a secure zone", signer, set.name)
+		}
+		return true, verifyRRset(set, signer, s.keys)
+	}
+
+	secure := true
+	q := r.Question[0]
+	name, t := dnsutil.Canonical(q.Header().Name), dns.RRToType(q)
+	answer := rrsets(m.Answer)
+	var wildcards []*rrset
+	for _, set := range answer {
+		ok, err := verify(set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+		if ok && int(set.sigs[0].Labels) < dnsutil.Labels(set.name) {
+			wildcards = append(wildcards, set)
+		}
+	}
+	// follow the CNAME chain to the name answering the question
+	for range 16 {
+		set := findRRset(answer, name, dns.TypeCNAME)
+		if set == nil || t == dns.TypeCNAME {
+			break
+		}
+		name = dnsutil.Canonical(set.rrs[0].(*dns.CNAME).Target)
+	}
+	positive := findRRset(answer, name, t) != nil || (t == dns.TypeANY && len(answer) > 0)
+	if positive && m.Rcode == dns.RcodeNameError {
+		return false, bogus("NXDOMAIN with answer for %s", name)
+	}
+
+	// negative answers are proved by the zone of name only, authority records
+	// out of it are ignored
+	var zone *zoneSecurity
+	if !positive {
+		var err error
+		if zone, err = security(ctx, name, exchange); err != nil {
+			return false, err
+		}
+	}
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	var ns []dns.RR
+	for _, set := range rrsets(m.Ns) {
+		if zone != nil && !dnsutil.IsBelow(zone.zone, set.name) {
+			continue
+		}
+		ok, err := verify(set)
+		if err != nil {
+			if positive && set.t != dns.TypeNSEC && set.t != dns.TypeNSEC3 {
+				// authority records of positive answers are not needed
+				continue
+			}
+			return false, err
+		}
+		if !ok {
+			// unsigned records prove nothing in a secure zone
+			if positive || zone.keys != nil {
+				continue
+			}
+			secure = false
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, rr)
+			case *dns.NSEC3:
+				if rr.Iterations > maxNSEC3Iterations {
+					return false, nil
+				}
+				nsec3 = append(nsec3, rr)
+			}
+		}
+		ns = append(ns, set.rrs...)
+		ns = append(ns, rrsToRR(set.sigs)...)
+	}
+	m.Ns = ns
+	if positive {
+		// wildcard answers must prove that the name itself does not exist
+		for _, set := range wildcards {
+			if !wildcardProved(set, nsec, nsec3) {
+				return false, bogus("no proof for wildcard answer %s", set.name)
+			}
+		}
+		return secure, nil
+	}
+
+	if zone.keys == nil {
+		return false, nil
+	}
+	if !denied(name, t, m.Rcode == dns.RcodeNameError, nsec, nsec3) {
+		return false, bogus("no proof of %s for %s %s", dnsutil.RcodeToString(m.Rcode), name, dnsutil.TypeToString(t))
+	}
+	return secure, nil
+}
+
+// wildcardProved reports whether the next closer name of the wildcard
+// expanded set does not exist, see RFC 5155 section 8.8 and RFC 4035 section
+// 5.3.4.
+func wildcardProved(set *rrset, nsec []*dns.NSEC, nsec3 []*dns.NSEC3) bool {
+	for _, i := range nsec {
+		if nsecCovers(i, set.name) {
+			return true
+		}
+	}
+	names := ancestors(set.name)
+	// the next closer name has one label more than the wildcard's parent
+	n := len(names) - 2 - int(set.sigs[0].Labels)
+	if n < 0 || n >= len(names) {
+		return false
+	}
+	for _, i := range nsec3 {
+		if nsec3Covers(i, names[n]) {
+			return true
+		}
+	}
+	return false
+}
+
+func rrsToRR[T dns.RR](rrs []T) []dns.RR {
+	res := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		res[i] = rr
+	}
+	return res
+}
+
+// dnssecReply prepares the validated answer m for the client of r: the AD bit
+// is only kept for clients asking with DO or AD, and DNSSEC records are only
+// sent to clients asking with DO.
+func dnssecReply(r, m *dns.Msg) *dns.Msg {
+	r.Unpack()
+	m.AuthenticatedData = m.AuthenticatedData && (r.Security || r.AuthenticatedData)
+	m.CheckingDisabled, m.Security = r.CheckingDisabled, r.Security
+	m.Data = nil
+	if r.Security {
+		return m
+	}
+	t := dns.RRToType(r.Question[0])
+	strip := func(rrs []dns.RR) (res []dns.RR) {
+		for _, rr := range rrs {
+			switch dns.RRToType(rr) {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if dns.RRToType(rr) != t {
+					continue
+				}
+			}
+			res = append(res, rr)
+		}
+		return
+	}
+	m.Answer, m.Ns = strip(m.Answer), strip(m.Ns)
+	return m
+}
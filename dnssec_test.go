@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// testZone is a signed zone answering DNSSEC queries as its authoritative
+// server would, forge may modify the answers.
+type testZone struct {
+	rrs   []dns.RR
+	forge func(q, m *dns.Msg)
+}
+
+var testZoneRecords = []string{
+	"example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300",
+	"example. 3600 IN NS ns.example.",
+	"example. 3600 IN NSEC ns.example. NS SOA RRSIG NSEC DNSKEY",
+	"ns.example. 3600 IN A 192.0.2.1",
+	"ns.example. 3600 IN NSEC www.example. A RRSIG NSEC",
+	"www.example. 300 IN A 192.0.2.2",
+	"www.example. 300 IN NSEC example. A RRSIG NSEC",
+}
+
+// newTestZone signs the zone example. with a new key and anchors it.
+func newTestZone(t *testing.T) *testZone {
+	t.Helper()
+	chainMu.Lock()
+	clear(chainCache)
+	chainMu.Unlock()
+	trustAnchors = nil
+
+	key := &dns.DNSKEY{Hdr: dns.Header{Name: "example.", Class: dns.ClassINET, TTL: 3600}}
+	key.Flags, key.Protocol, key.Algorithm = dns.FlagZONE|dns.FlagSEP, 3, dns.ED25519
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := &testZone{rrs: []dns.RR{key}}
+	for _, i := range testZoneRecords {
+		rr, err := dns.New(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+	for _, set := range rrsets(z.rrs) {
+		sig := dns.NewRRSIG("example.", key.Algorithm, key.KeyTag())
+		if err := sig.Sign(priv.(crypto.Signer), set.rrs, &dns.SignOption{}); err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, sig)
+	}
+	if err := addTrustAnchor(key.String(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+// rrset returns the records of name and t with their signatures.
+func (z *testZone) rrset(name string, t uint16) (rrs []dns.RR) {
+	for _, rr := range z.rrs {
+		if dnsutil.Canonical(rr.Header().Name) != name {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t || dns.RRToType(rr) == t {
+			rrs = append(rrs, rr)
+		}
+	}
+	return
+}
+
+func (z *testZone) ExchangeContext(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, q)
+	m.Authoritative = true
+	name, t := dnsutil.Canonical(q.Question[0].Header().Name), dns.RRToType(q.Question[0])
+	if m.Answer = z.rrset(name, t); len(m.Answer) == 0 {
+		m.Ns = z.rrset("example.", dns.TypeSOA)
+		if nsec := z.rrset(name, dns.TypeNSEC); len(nsec) > 0 {
+			m.Ns = append(m.Ns, nsec...)
+		} else {
+			m.Rcode = dns.RcodeNameError
+			for _, rr := range z.rrs {
+				if nsec, ok := rr.(*dns.NSEC); ok && (nsecCovers(nsec, name) || nsecCovers(nsec, "*.example.")) {
+					m.Ns = append(m.Ns, z.rrset(nsec.Hdr.Name, dns.TypeNSEC)...)
+				}
+			}
+		}
+	}
+	if z.forge != nil {
+		z.forge(q, m)
+	}
+	return m, nil
+}
+
+func (*testZone) Name() string { return "example" }
+
+func TestValidate(t *testing.T) {
+	forged := func(q, m *dns.Msg) {
+		if dnsutil.Canonical(q.Question[0].Header().Name) != "www.example." || dns.RRToType(q.Question[0]) != dns.TypeA {
+			return
+		}
+		ns, _ := dns.New("x.unsigned-tld. 3600 IN NS ns.unsigned-tld.")
+		m.Rcode = dns.RcodeNameError
+		m.Answer = nil
+		m.Ns = append(m.Ns, ns)
+	}
+	tampered := func(q, m *dns.Msg) {
+		for i, rr := range m.Answer {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeA {
+				sig = sig.Clone().(*dns.RRSIG)
+				sig.Expiration++
+				m.Answer[i] = sig
+			}
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		qname string
+		qtype uint16
+		forge func(q, m *dns.Msg)
+		rcode uint16
+		ad    bool
+	}{
+		{"answer", "www.example.", dns.TypeA, nil, dns.RcodeSuccess, true},
+		{"nxdomain", "nx.example.", dns.TypeA, nil, dns.RcodeNameError, true},
+		{"nodata", "ns.example.", dns.TypeTXT, nil, dns.RcodeSuccess, true},
+		{"tampered", "www.example.", dns.TypeA, tampered, dns.RcodeServerFailure, false},
+		{"forged nxdomain", "www.example.", dns.TypeA, forged, dns.RcodeServerFailure, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			z := newTestZone(t)
+			z.forge = tc.forge
+			res, bogus, err := resolveSecure(t.Context(), dns.NewMsg(tc.qname, tc.qtype), []Client{z}, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m := res.msg; m.Rcode != tc.rcode || m.AuthenticatedData != tc.ad || bogus != (tc.rcode == dns.RcodeServerFailure) {
+				t.Errorf("expected %s with AD %t; got %s with AD %t, bogus %t",
+					dnsutil.RcodeToString(tc.rcode), tc.ad, dnsutil.RcodeToString(m.Rcode), m.AuthenticatedData, bogus)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+)
+
+// Client subnet modes of an upstream group.
+const (
+	ecsStrip   = "strip"
+	ecsForward = "forward"
+	ecsClient  = "client"
+	ecsFixed   = "fixed"
+)
+
+// ecsPolicy is how the EDNS Client Subnet option (RFC 7871) of queries sent to
+// an upstream group is set.
+type ecsPolicy struct {
+	mode   string
+	v4, v6 int
+	subnet netip.Prefix
+}
+
+var primaryECS, backupECS *ecsPolicy
+
+// parseECS parses strip, forward, client[/ipv4 prefix[/ipv6 prefix]] or a
+// fixed subnet.
+func parseECS(s string) (*ecsPolicy, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "":
+		return nil, nil
+	case ecsStrip, ecsForward:
+		return &ecsPolicy{mode: s}, nil
+	}
+	if lengths, ok := strings.CutPrefix(s, ecsClient); ok {
+		p := &ecsPolicy{mode: ecsClient, v4: ipv4Prefix, v6: ipv6Prefix}
+		if lengths == "" {
+			return p, nil
+		}
+		v4, v6, _ := strings.Cut(strings.TrimPrefix(lengths, "/"), "/")
+		var err error
+		if p.v4, err = strconv.Atoi(v4); err != nil || p.v4 < 0 || p.v4 > 32 {
+			return nil, errors.New("bad IPv4 prefix length " + v4)
+		}
+		if v6 != "" {
+			if p.v6, err = strconv.Atoi(v6); err != nil || p.v6 < 0 || p.v6 > 128 {
+				return nil, errors.New("bad IPv6 prefix length " + v6)
+			}
+		}
+		return p, nil
+	}
+	subnet, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ecsPolicy{mode: ecsFixed, subnet: subnet.Masked()}, nil
+}
+
+func initECS(primary, backup string) {
+	var err error
+	if primaryECS, err = parseECS(primary); err != nil {
+		svc.Error("illegal client subnet", "ecs", primary, "error", err)
+	}
+	if backupECS, err = parseECS(backup); err != nil {
+		svc.Error("illegal client subnet", "backup-ecs", backup, "error", err)
+	}
+}
+
+type ecsKey struct{}
+
+// requestClient is the address and client subnet option of a request.
+type requestClient struct {
+	addr   netip.Addr
+	subnet *dns.SUBNET
+}
+
+// withClient returns a context carrying the client address and the client
+// subnet option of r.
+func withClient(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) context.Context {
+	c := requestClient{addr: remoteAddr(w)}
+	if r.Unpack() == nil {
+		c.subnet = findSubnet(r.Pseudo)
+	}
+	return context.WithValue(ctx, ecsKey{}, c)
+}
+
+func findSubnet(rrs []dns.RR) *dns.SUBNET {
+	for _, rr := range rrs {
+		if s, ok := rr.(*dns.SUBNET); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func isSubnet(rr dns.RR) bool {
+	_, ok := rr.(*dns.SUBNET)
+	return ok
+}
+
+// prefix returns the subnet to send for the client of ctx, invalid for none.
+// Synthesized subnets are not sent for private clients.
+func (p *ecsPolicy) prefix(ctx context.Context) netip.Prefix {
+	if p == nil {
+		return netip.Prefix{}
+	}
+	c, _ := ctx.Value(ecsKey{}).(requestClient)
+	switch p.mode {
+	case ecsForward:
+		if c.subnet != nil && c.subnet.Address.IsValid() {
+			if prefix, err := c.subnet.Address.Unmap().Prefix(int(c.subnet.Netmask)); err == nil {
+				return prefix
+			}
+		}
+	case ecsClient:
+		if addr := c.addr.Unmap(); addr.IsGlobalUnicast() && !addr.IsPrivate() {
+			if addr.Is4() {
+				return netip.PrefixFrom(addr, p.v4).Masked()
+			}
+			return netip.PrefixFrom(addr, p.v6).Masked()
+		}
+	case ecsFixed:
+		return p.subnet
+	}
+	return netip.Prefix{}
+}
+
+func newSubnet(prefix netip.Prefix) *dns.SUBNET {
+	s := &dns.SUBNET{Family: 1, Netmask: uint8(prefix.Bits()), Address: prefix.Addr()}
+	if prefix.Addr().Is6() {
+		s.Family = 2
+	}
+	return s
+}
+
+// ecsUpstream is an upstream DNS of a group with a client subnet policy.
+type ecsUpstream struct {
+	Client
+	policy *ecsPolicy
+}
+
+// withECS applies policy to the clients of a group, replacing the policy they
+// had already.
+func withECS(clients []Client, policy *ecsPolicy) (res []Client) {
+	for _, c := range clients {
+		if e, ok := c.(*ecsUpstream); ok {
+			c = e.Client
+		}
+		if policy != nil {
+			c = &ecsUpstream{c, policy}
+		}
+		res = append(res, c)
+	}
+	return
+}
+
+// groupECS returns the client subnet policy of a group.
+func groupECS(clients []Client) *ecsPolicy {
+	if len(clients) > 0 {
+		if e, ok := clients[0].(*ecsUpstream); ok {
+			return e.policy
+		}
+	}
+	return nil
+}
+
+type policyKey struct{}
+
+// ExchangeContext passes the policy to the upstream DNS, which applies it when
+// building its query with upstreamQuery.
+func (c *ecsUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return c.Client.ExchangeContext(context.WithValue(ctx, policyKey{}, c.policy), m)
+}
+
+// withSubnet replaces the client subnet option of the query q as the policy
+// of ctx tells, if any.
+func withSubnet(ctx context.Context, q *dns.Msg) {
+	p, ok := ctx.Value(policyKey{}).(*ecsPolicy)
+	if !ok {
+		return
+	}
+	q.Pseudo = slices.DeleteFunc(slices.Clone(q.Pseudo), isSubnet)
+	if prefix := p.prefix(ctx); prefix.IsValid() {
+		q.Pseudo = append(q.Pseudo, newSubnet(prefix))
+	}
+}
+
+// ecsCacheKey returns the cache key of the answer m, which is only shared by
+// clients in the subnet of its scope.
+func ecsCacheKey(key string, m *dns.Msg) string {
+	s := findSubnet(m.Pseudo)
+	if s == nil || s.Scope == 0 || !s.Address.IsValid() {
+		return key
+	}
+	prefix, err := s.Address.Unmap().Prefix(int(min(s.Scope, s.Netmask)))
+	if err != nil {
+		return key
+	}
+	return key + "/" + prefix.String()
+}
+
+// getECSCache looks up the answer of key scoped to the longest match of the
+// subnet sent for the client, then the one shared by all clients.
+func getECSCache(key string, prefix netip.Prefix) (*dns.Msg, bool) {
+	if prefix.IsValid() {
+		for bits := prefix.Bits(); bits > 0; bits-- {
+			p, _ := prefix.Addr().Prefix(bits)
+			if m, ok := getCache(key + "/" + p.String()); ok {
+				return m, true
+			}
+		}
+	}
+	return getCache(key)
+}
+
+// ecsReply replaces the client subnet option of the upstream answer m with
+// the one of the client, if it sent one.
+func ecsReply(ctx context.Context, m *dns.Msg) *dns.Msg {
+	c, _ := ctx.Value(ecsKey{}).(requestClient)
+	upstream := findSubnet(m.Pseudo)
+	if upstream == nil && c.subnet == nil {
+		return m
+	}
+	m.Pseudo = slices.DeleteFunc(slices.Clone(m.Pseudo), isSubnet)
+	if c.subnet != nil {
+		echo := *c.subnet
+		echo.Scope = 0
+		if upstream != nil && upstream.Address == c.subnet.Address && upstream.Netmask == c.subnet.Netmask {
+			echo.Scope = upstream.Scope
+		}
+		m.Pseudo = append(m.Pseudo, &echo)
+	}
+	m.Data = nil
+	return m
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/svcb"
+	"github.com/sunshineplan/utils/txt"
+)
+
+// Address families of answers.
+const (
+	familyBoth       = "both"
+	familyIPv4       = "ipv4"
+	familyIPv6       = "ipv6"
+	familyPreferIPv4 = "prefer-ipv4"
+	familyPreferIPv6 = "prefer-ipv6"
+)
+
+func validFamily(s string) bool {
+	return slices.Contains([]string{familyBoth, familyIPv4, familyIPv6, familyPreferIPv4, familyPreferIPv6}, s)
+}
+
+// familyRules is the address family of answers, by domain and global.
+type familyRules struct {
+	global  string
+	domains map[string]string
+}
+
+var currentFamily atomic.Pointer[familyRules]
+
+// mode returns the address family of the closest domain of name.
+func (f *familyRules) mode(name string) string {
+	if f == nil {
+		return familyBoth
+	}
+	name = dnsutil.Canonical(name)
+	for off, end := 0, false; !end; off, end = dnsutil.Next(name, off) {
+		if mode, ok := f.domains[name[off:]]; ok {
+			return mode
+		}
+	}
+	return f.global
+}
+
+// loadFamilyRules reads the address family rules file, a domain and its
+// family per line.
+func loadFamilyRules(file string) (map[string]string, error) {
+	rows, err := txt.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string]string)
+	for line, i := range rows {
+		if i = strings.TrimSpace(i); i == "" || strings.HasPrefix(i, "#") {
+			continue
+		}
+		fields := strings.Fields(i)
+		if len(fields) != 2 || !validFamily(strings.ToLower(fields[1])) {
+			svc.Error("illegal address family rule", "file", file, "line", line+1, "row", i)
+			continue
+		}
+		domains[dnsutil.Canonical(fields[0])] = strings.ToLower(fields[1])
+	}
+	return domains, nil
+}
+
+// initFamily sets the global address family and loads the rules file, which
+// is reloaded when changed. Answers are filtered before caching, so cached
+// answers of changed domains are dropped on reload.
+func initFamily(mode, file string) {
+	if mode = strings.ToLower(mode); !validFamily(mode) {
+		svc.Error("unknown address family", "family", mode)
+		mode = familyBoth
+	}
+	if file == "" {
+		if mode != familyBoth {
+			currentFamily.Store(&familyRules{global: mode})
+		}
+		return
+	}
+	load := func() {
+		domains, err := loadFamilyRules(file)
+		if err != nil {
+			svc.Error("failed to load address family rules", "file", file, "error", err)
+			return
+		}
+		var changed []string
+		if old := currentFamily.Load(); old != nil {
+			for domain, mode := range old.domains {
+				if domains[domain] != mode {
+					changed = append(changed, domain)
+				}
+			}
+			for domain := range domains {
+				if _, ok := old.domains[domain]; !ok {
+					changed = append(changed, domain)
+				}
+			}
+		}
+		currentFamily.Store(&familyRules{global: mode, domains: domains})
+		invalidateCache(changed)
+	}
+	load()
+	if err := watchPaths([]string{file}, "", func() {
+		svc.Print("reload address family rules ", file)
+		load()
+	}); err != nil {
+		svc.Error("failed to watch address family rules", "file", file, "error", err)
+	}
+}
+
+// filterFamily removes the addresses of the family not wanted for the name of
+// r from its answer m. With a preferred family, addresses of the other family
+// are only removed if lookup finds addresses of the preferred one for the
+// name. Address hints of HTTPS and SVCB records are filtered alike.
+func filterFamily(r, m *dns.Msg, lookup func(t uint16) (*dns.Msg, error)) *dns.Msg {
+	q := r.Question[0]
+	mode := currentFamily.Load().mode(q.Header().Name)
+	if mode == familyBoth || m.Rcode != dns.RcodeSuccess {
+		return m
+	}
+	has := func(t uint16) bool {
+		m, err := lookup(t)
+		return err == nil && slices.ContainsFunc(m.Answer, func(rr dns.RR) bool { return dns.RRToType(rr) == t })
+	}
+	var drop uint16
+	switch t := dns.RRToType(q); t {
+	case dns.TypeA, dns.TypeAAAA:
+		switch {
+		case mode == familyIPv4, mode == familyPreferIPv4 && t == dns.TypeAAAA && has(dns.TypeA):
+			drop = dns.TypeAAAA
+		case mode == familyIPv6, mode == familyPreferIPv6 && t == dns.TypeA && has(dns.TypeAAAA):
+			drop = dns.TypeA
+		}
+		if drop != t {
+			return m
+		}
+		svc.Debug("drop address family", "question", r.Question, "family", mode)
+		m.Answer = slices.DeleteFunc(m.Answer, func(rr dns.RR) bool {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				return sig.TypeCovered == drop
+			}
+			return dns.RRToType(rr) == drop
+		})
+		m.AuthenticatedData = false
+		withSOA(r, m, lookup)
+	case dns.TypeHTTPS, dns.TypeSVCB:
+		var changed bool
+		for i, rr := range m.Answer {
+			if s := svcbOf(rr); s != nil {
+				if v := filterHints(s.Value, mode); len(v) != len(s.Value) {
+					rr = rr.Clone()
+					svcbOf(rr).Value = v
+					m.Answer[i], changed = rr, true
+				}
+			}
+		}
+		if changed {
+			svc.Debug("filter address hints", "question", r.Question, "family", mode)
+			m.Answer = slices.DeleteFunc(m.Answer, func(rr dns.RR) bool {
+				sig, ok := rr.(*dns.RRSIG)
+				return ok && sig.TypeCovered == t
+			})
+			m.AuthenticatedData = false
+		}
+	}
+	return m
+}
+
+// withSOA adds the SOA record of the zone of the name of r to the answer m
+// when no records of the type asked are left in it, so that clients can cache
+// it as a negative answer, see RFC 2308 section 5.
+func withSOA(r, m *dns.Msg, lookup func(t uint16) (*dns.Msg, error)) {
+	t := dns.RRToType(r.Question[0])
+	if slices.ContainsFunc(m.Answer, func(rr dns.RR) bool { return dns.RRToType(rr) == t }) ||
+		slices.ContainsFunc(m.Ns, func(rr dns.RR) bool { return dns.RRToType(rr) == dns.TypeSOA }) {
+		return
+	}
+	res, err := lookup(dns.TypeSOA)
+	if err != nil {
+		return
+	}
+	for _, rr := range slices.Concat(res.Answer, res.Ns) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa = soa.Clone().(*dns.SOA)
+			soa.Hdr.TTL = min(soa.Hdr.TTL, soa.Minttl)
+			m.Ns = append(m.Ns, soa)
+			return
+		}
+	}
+}
+
+// filterHints removes the address hints of the family not wanted by mode.
+func filterHints(pairs []svcb.Pair, mode string) []svcb.Pair {
+	has := func(key uint16) bool {
+		return slices.ContainsFunc(pairs, func(p svcb.Pair) bool { return svcb.PairToKey(p) == key })
+	}
+	var drop uint16
+	switch {
+	case mode == familyIPv4, mode == familyPreferIPv4 && has(svcb.KeyIPv4Hint):
+		drop = svcb.KeyIPv6Hint
+	case mode == familyIPv6, mode == familyPreferIPv6 && has(svcb.KeyIPv6Hint):
+		drop = svcb.KeyIPv4Hint
+	default:
+		return pairs
+	}
+	if !has(drop) {
+		return pairs
+	}
+	return slices.DeleteFunc(slices.Clone(pairs), func(p svcb.Pair) bool { return svcb.PairToKey(p) == drop })
+}
@@ -10,6 +10,7 @@ require (
 	github.com/sunshineplan/utils v0.1.85
 	github.com/sunshineplan/workers v1.0.6
 	golang.org/x/net v0.57.0
+	golang.org/x/sync v0.19.0
 )
 
 require (
@@ -17,6 +18,5 @@ require (
 	github.com/mattn/go-runewidth v0.0.19 // indirect
 	github.com/sunshineplan/progressbar v1.0.1 // indirect
 	golang.org/x/crypto v0.54.0 // indirect
-	golang.org/x/sync v0.19.0 // indirect
 	golang.org/x/sys v0.47.0 // indirect
 )
@@ -1,76 +1,191 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 
 	"codeberg.org/miekg/dns"
 	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
 	"github.com/sunshineplan/utils/txt"
 )
 
-func initHosts(file string) {
-	if file = strings.TrimSpace(file); file == "" {
-		return
+// hostsExt is the extension of hosts files loaded from a hosts directory.
+const hostsExt = ".hosts"
+
+// hostsTTL is the TTL of records answered from hosts files.
+const hostsTTL = 3600
+
+// hostsTable holds the static records from hosts files, kept apart from the
+// dynamic dnsCache so that they survive cache invalidation. Names are stored
+// in canonical form, wildcard entries like *.example.com are stored by their
+// parent name.
+type hostsTable struct {
+	names    map[string]*hostsEntry
+	wildcard map[string]*hostsEntry
+	reverse  map[netip.Addr][]string
+}
+
+type hostsEntry struct {
+	ipv4 []netip.Addr
+	ipv6 []netip.Addr
+}
+
+var currentHosts atomic.Pointer[hostsTable]
+
+// getHosts answers r from hosts table t. Names found in hosts files are
+// authoritative, so missing types are answered with NODATA instead of being
+// forwarded.
+func getHosts(t *hostsTable, r *dns.Msg) (*dns.Msg, bool) {
+	if t == nil {
+		return nil, false
 	}
 
-	rows, err := txt.ReadFile(file)
-	if err != nil {
-		svc.Error("failed to load hosts list file", "error", err)
-		return
+	q := r.Question[0]
+	name := dnsutil.Canonical(q.Header().Name)
+	qType := dns.RRToType(q)
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.Authoritative, m.RecursionAvailable = true, true
+	hdr := dns.Header{Name: q.Header().Name, Class: dns.ClassINET, TTL: hostsTTL}
+
+	if qType == dns.TypePTR && dnsutil.IsReverse(name) > 0 {
+		names, ok := t.reverse[dnsutil.AddrReverse(name).Unmap()]
+		if !ok {
+			return nil, false
+		}
+		for _, i := range names {
+			m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, PTR: rdata.PTR{Ptr: i}})
+		}
+		return m, true
 	}
 
-	ipv4 := make(map[string][]net.IP)
-	ipv6 := make(map[string][]net.IP)
-	for line, i := range rows {
-		elem := fmtHostsRow(i)
-		if l := len(elem); l == 0 {
-			continue
-		} else if l < 2 {
-			svc.Error("illegal hosts row", "line", line, "row", i)
-			continue
+	e, ok := t.lookup(name)
+	if !ok {
+		return nil, false
+	}
+	if qType == dns.TypeA || qType == dns.TypeANY {
+		for _, ip := range e.ipv4 {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: rdata.A{Addr: ip}})
 		}
-		ip := net.ParseIP(elem[0])
-		if ip == nil {
-			svc.Error("illegal hosts row", "line", line, "row", i)
-			continue
+	}
+	if qType == dns.TypeAAAA || qType == dns.TypeANY {
+		for _, ip := range e.ipv6 {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: rdata.AAAA{Addr: ip}})
 		}
-		ipMap := ipv4
-		if ip.DefaultMask() == nil {
-			ipMap = ipv6
+	}
+	return m, true
+}
+
+// lookup finds the entry of name, falling back to the closest wildcard entry.
+func (t *hostsTable) lookup(name string) (*hostsEntry, bool) {
+	if e, ok := t.names[name]; ok {
+		return e, true
+	}
+	for off, end := dnsutil.Next(name, 0); !end; off, end = dnsutil.Next(name, off) {
+		if e, ok := t.wildcard[name[off:]]; ok {
+			return e, true
 		}
-		for index, i := range elem {
-			if index == 0 {
-				continue
-			}
-			svc.Debug("hosts", "host", i, "ip", ip)
-			ipMap[i] = append(ipMap[i], ip)
+	}
+	return nil, false
+}
+
+// initHosts loads the hosts files into p and reloads them when changed.
+func initHosts(s string, p *atomic.Pointer[hostsTable]) {
+	var paths []string
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			paths = append(paths, i)
 		}
 	}
+	if len(paths) == 0 {
+		return
+	}
 
-	importHosts(ipv4, dns.TypeA)
-	importHosts(ipv6, dns.TypeAAAA)
+	p.Store(loadHosts(paths))
+	if err := watchPaths(paths, hostsExt, func() {
+		svc.Print("reload hosts ", s)
+		p.Store(loadHosts(paths))
+	}); err != nil {
+		svc.Error("failed to watch hosts", "error", err)
+	}
 }
 
-func importHosts(s map[string][]net.IP, t uint16) {
-	qType := "A"
-	if t == dns.TypeAAAA {
-		qType = "AAAA"
+// hostsFiles expands hosts directories into the hosts files they contain.
+func hostsFiles(paths []string) (files []string) {
+	for _, i := range paths {
+		if info, err := os.Stat(i); err == nil && info.IsDir() {
+			matches, err := filepath.Glob(filepath.Join(i, "*"+hostsExt))
+			if err != nil {
+				svc.Error("failed to list hosts directory", "error", err)
+				continue
+			}
+			files = append(files, matches...)
+		} else {
+			files = append(files, i)
+		}
 	}
+	return
+}
 
-	for k, v := range s {
-		m := dns.NewMsg(dnsutil.Fqdn(k), t)
-		for _, ip := range v {
-			s := fmt.Sprintf("%s %s %s", dnsutil.Fqdn(k), qType, ip)
-			rr, err := dns.New(s)
+func loadHosts(paths []string) *hostsTable {
+	t := &hostsTable{
+		names:    make(map[string]*hostsEntry),
+		wildcard: make(map[string]*hostsEntry),
+		reverse:  make(map[netip.Addr][]string),
+	}
+	for _, file := range hostsFiles(paths) {
+		rows, err := txt.ReadFile(file)
+		if err != nil {
+			svc.Error("failed to load hosts list file", "error", err)
+			continue
+		}
+		for line, i := range rows {
+			elem := fmtHostsRow(i)
+			if l := len(elem); l == 0 {
+				continue
+			} else if l < 2 {
+				svc.Error("illegal hosts row", "file", file, "line", line, "row", i)
+				continue
+			}
+			ip, err := netip.ParseAddr(elem[0])
 			if err != nil {
-				svc.Error("failed to create record", "error", err, "content", s)
+				svc.Error("illegal hosts row", "file", file, "line", line, "row", i)
 				continue
 			}
-			m.Answer = append(m.Answer, rr)
+			ip = ip.WithZone("").Unmap()
+			for _, i := range elem[1:] {
+				svc.Debug("hosts", "host", i, "ip", ip)
+				t.add(i, ip)
+			}
+		}
+	}
+	return t
+}
+
+func (t *hostsTable) add(host string, ip netip.Addr) {
+	name := dnsutil.Canonical(host)
+	entries := t.names
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		name, entries = parent, t.wildcard
+	} else if !slices.Contains(t.reverse[ip], name) {
+		t.reverse[ip] = append(t.reverse[ip], name)
+	}
+	e, ok := entries[name]
+	if !ok {
+		e = new(hostsEntry)
+		entries[name] = e
+	}
+	if ip.Is4() {
+		if !slices.Contains(e.ipv4, ip) {
+			e.ipv4 = append(e.ipv4, ip)
 		}
-		dnsCache.Set(fmt.Sprint(m.Question), m, 0, nil)
+	} else if !slices.Contains(e.ipv6, ip) {
+		e.ipv6 = append(e.ipv6, ip)
 	}
 }
 
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/sunshineplan/utils/txt"
+)
+
+// journalSize is the maximum number of differences kept in a journal.
+const journalSize = 100
+
+// zoneDiff is the difference between two versions of a zone, in the order of
+// an IXFR response.
+type zoneDiff struct {
+	from, to *dns.SOA
+	del, add []dns.RR
+}
+
+func (d *zoneDiff) rrs() (rrs []dns.RR) {
+	rrs = append(rrs, d.from)
+	rrs = append(rrs, d.del...)
+	rrs = append(rrs, d.to)
+	return append(rrs, d.add...)
+}
+
+// diffZone returns the difference from old to new.
+func diffZone(old, new *zone) *zoneDiff {
+	d := &zoneDiff{from: old.soa, to: new.soa}
+	oldRRs, newRRs := make(map[string]bool), make(map[string]bool)
+	for _, rr := range old.all() {
+		oldRRs[rr.String()] = true
+	}
+	for _, rr := range new.all() {
+		newRRs[rr.String()] = true
+		if !oldRRs[rr.String()] {
+			d.add = append(d.add, rr)
+		}
+	}
+	for _, rr := range old.all() {
+		if !newRRs[rr.String()] {
+			d.del = append(d.del, rr)
+		}
+	}
+	return d
+}
+
+// rrKey identifies rr regardless of its TTL and the case of its owner name.
+func rrKey(rr dns.RR) string {
+	rr = rr.Clone()
+	rr.Header().Name = dnsutil.Canonical(rr.Header().Name)
+	rr.Header().Class, rr.Header().TTL = dns.ClassINET, 0
+	return rr.String()
+}
+
+// patch applies the chain of differences to z and returns the new version.
+func (z *zone) patch(diffs []*zoneDiff) (*zone, error) {
+	records := make(map[string]dns.RR)
+	for _, rr := range z.all() {
+		records[rrKey(rr)] = rr
+	}
+	soa := z.soa
+	for _, d := range diffs {
+		if d.from.Serial != soa.Serial {
+			return nil, fmt.Errorf("difference from serial %d, but have %d", d.from.Serial, soa.Serial)
+		}
+		for _, rr := range d.del {
+			delete(records, rrKey(rr))
+		}
+		for _, rr := range d.add {
+			records[rrKey(rr)] = rr
+		}
+		soa = d.to
+	}
+	rrs := []dns.RR{soa}
+	for _, rr := range records {
+		rrs = append(rrs, rr)
+	}
+	return newZone(z.origin, rrs)
+}
+
+// journal keeps the differences between versions of a zone for IXFR. It is
+// stored as text, each record prefixed with - for deletion or + for addition,
+// a deleted SOA record starts a new difference.
+type journal struct {
+	mu    sync.RWMutex
+	file  string
+	diffs []*zoneDiff
+}
+
+func loadJournal(file string) (*journal, error) {
+	j := &journal{file: file}
+	rows, err := txt.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return j, nil
+		}
+		return j, err
+	}
+
+	var d *zoneDiff
+	for line, i := range rows {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		rr, err := dns.New(i[1:])
+		if err != nil {
+			return j, fmt.Errorf("line %d: %w", line+1, err)
+		}
+		soa, isSOA := rr.(*dns.SOA)
+		switch {
+		case i[0] == '-' && isSOA:
+			d = &zoneDiff{from: soa}
+			j.diffs = append(j.diffs, d)
+		case d == nil:
+			return j, fmt.Errorf("line %d: journal must start with deleted SOA", line+1)
+		case i[0] == '+' && isSOA:
+			d.to = soa
+		case i[0] == '-':
+			d.del = append(d.del, rr)
+		case i[0] == '+':
+			d.add = append(d.add, rr)
+		default:
+			return j, fmt.Errorf("line %d: illegal journal row", line+1)
+		}
+	}
+	for _, d := range j.diffs {
+		if d.to == nil {
+			j.diffs = nil
+			return j, errors.New("incomplete journal")
+		}
+	}
+	return j, nil
+}
+
+// last returns the serial of the latest version recorded.
+func (j *journal) last() (uint32, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if n := len(j.diffs); n > 0 {
+		return j.diffs[n-1].to.Serial, true
+	}
+	return 0, false
+}
+
+// since returns the chain of differences from serial to the latest version.
+func (j *journal) since(serial uint32) ([]*zoneDiff, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	for i, d := range j.diffs {
+		if d.from.Serial == serial {
+			return j.diffs[i:], true
+		}
+	}
+	return nil, false
+}
+
+func (j *journal) append(d *zoneDiff) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if n := len(j.diffs); n > 0 && j.diffs[n-1].to.Serial != d.from.Serial {
+		j.diffs = nil
+	}
+	j.diffs = append(j.diffs, d)
+	if n := len(j.diffs); n > journalSize {
+		j.diffs = j.diffs[n-journalSize:]
+	}
+	return j.save()
+}
+
+func (j *journal) reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.diffs = nil
+	return j.save()
+}
+
+func (j *journal) save() error {
+	if j.file == "" {
+		return nil
+	}
+	var rows []string
+	for _, d := range j.diffs {
+		rows = append(rows, "-"+d.from.String())
+		for _, rr := range d.del {
+			rows = append(rows, "-"+rr.String())
+		}
+		rows = append(rows, "+"+d.to.String())
+		for _, rr := range d.add {
+			rows = append(rows, "+"+rr.String())
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(j.file), "."+filepath.Base(j.file)+".tmp")
+	if err := txt.ExportFile(rows, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.file)
+}
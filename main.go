@@ -16,20 +16,59 @@ import (
 var svc = service.New()
 
 var (
-	primary  = flag.String("primary", "", `List of primary DNS, separated with commas`)
-	backup   = flag.String("backup", "", `List of backup DNS`)
-	exclude  = flag.String("exclude", "", "Exclusion list `file` which only use backup DNS")
-	hosts    = flag.String("hosts", "", "Hosts `file`")
-	mode     = flag.String("mode", "UDP", "DNS mode (UDP, TCP, DoT, DoH)")
-	port     = flag.Int("port", 0, "DNS server port (default: UDP&TCP-53, DoT-853, DoH-443)")
-	cert     = flag.String("cert", "", "Path to certificate file, for DoT or DoH mode")
-	privkey  = flag.String("privkey", "", "Path to private key file, for DoT or DoH mode")
-	unix     = flag.String("unix", "", "Path to Unix socket, only for DoH mode")
-	dnsProxy = flag.String("proxy", "", "List of proxies for DNS")
-	fallback = flag.Bool("fallback", false, "Enable fallback")
-	timeout  = flag.Duration("timeout", 5*time.Second, "Query timeout")
-	logPath  = flag.String("log", "", "Path to log file")
-	debug    = flag.Bool("debug", false, "debug")
+	primary       = flag.String("primary", "", `List of primary DNS, separated with commas`)
+	backup        = flag.String("backup", "", `List of backup DNS`)
+	primarySubnet = flag.String("ecs", "", "EDNS Client Subnet of queries to primary DNS (strip, forward, client[/24/56] or a fixed subnet)")
+	backupSubnet  = flag.String("backup-ecs", "", "EDNS Client Subnet of queries to backup DNS")
+	resolvConf    = flag.String("resolv-conf", "/etc/resolv.conf", "Path to resolv.conf `file` of the system DNS")
+	rootHints     = flag.String("root-hints", "", "Root hints `file` of the recursive resolver (default: built-in root servers)")
+	exclude       = flag.String("exclude", "", "Exclusion list `file` which only use backup DNS")
+	hosts         = flag.String("hosts", "", "List of hosts `files` or directories of *.hosts files, separated with commas")
+	block         = flag.String("block", "", "Blocklist `file` of domains answered with NXDOMAIN")
+	viewsFile     = flag.String("views", "", "Views `file` of client groups with their own settings")
+	rewrite       = flag.String("rewrite", "", "Rewrite rules `file`")
+	zones         = flag.String("zones", "", "List of local zones as origin=`file`, separated with commas")
+	secondary     = flag.String("secondary", "", "List of secondary zones as origin=primary[/key], separated with commas")
+	tsig          = flag.String("tsig", "", "List of TSIG keys as [algorithm:]name:secret, separated with commas")
+	transfer      = flag.String("transfer", "", "List of IP addresses or CIDR prefixes allowed to transfer local zones")
+	notifyList    = flag.String("notify", "", "List of secondaries to notify when local zones change")
+	allow         = flag.String("allow", "", "List of IP addresses or CIDR prefixes allowed to query (default: private and loopback)")
+	deny          = flag.String("deny", "", "List of IP addresses or CIDR prefixes denied to query")
+	drop          = flag.Bool("drop", false, "Drop queries of denied clients silently instead of answering REFUSED")
+	trustedProxy  = flag.String("trusted-proxy", "", "List of trusted proxies whose X-Forwarded-For is used, for DoH mode")
+	rateLimit     = flag.Float64("rate-limit", 0, "Queries per second allowed from each client prefix (/24 or /56), 0 to disable")
+	rateBurst     = flag.Int("rate-burst", 0, "Burst of queries allowed from each client prefix (default: rate limit)")
+	rrl           = flag.Float64("rrl", 0, "Identical responses per second allowed to each client prefix on UDP, 0 to disable")
+	rrlSlip       = flag.Int("rrl-slip", 2, "Send every Nth rate limited response truncated instead of dropping it, 0 to never")
+	cookie        = flag.Bool("cookie", false, "Enable DNS cookies for UDP clients, clients with valid cookies are not rate limited")
+	cookieRotate  = flag.Duration("cookie-rotate", 24*time.Hour, "Interval between cookie secret rotations")
+	dnssec        = flag.Bool("dnssec", false, "Validate upstream answers with DNSSEC")
+	anchors       = flag.String("trust-anchor", "", "Trust anchor `file` of DS or DNSKEY records, kept up to date as RFC 5011 (default: root anchors)")
+	dns64         = flag.Bool("dns64", false, "Synthesize AAAA records from A records for IPv6-only clients behind NAT64")
+	dns64Prefix   = flag.String("dns64-prefix", "64:ff9b::/96", "NAT64 /96 `prefix` of synthesized AAAA records")
+	dns64Exclude  = flag.String("dns64-exclude", "0.0.0.0/8,127.0.0.0/8,169.254.0.0/16,255.255.255.255/32", "List of IPv4 prefixes never synthesized into AAAA records")
+	family        = flag.String("family", "both", "Address family of answers (both, ipv4, ipv6, prefer-ipv4, prefer-ipv6)")
+	familyFile    = flag.String("family-rules", "", "Address family rules `file` of a domain and its family per line")
+	speedCheck    = flag.String("speed-check", "", "List of probes (ping, tcp:port) ordering answer addresses by latency, separated with commas")
+	speedFastest  = flag.Bool("speed-check-fastest", false, "Keep only the fastest address of speed checked answers")
+	speedTimeout  = flag.Duration("speed-check-timeout", 300*time.Millisecond, "Timeout of each speed check probe")
+	chaosVersion  = flag.String("chaos-version", "", "Answer of CHAOS version.bind queries, hidden if empty")
+	chaosID       = flag.String("chaos-id", "", "Answer of CHAOS hostname.bind and id.server queries, hidden if empty")
+	anyMode       = flag.String("any", "minimal", "How to answer ANY queries (minimal, refuse, forward)")
+	udpSize       = flag.Int("udp-size", 1232, "Maximum size of UDP responses, responses larger than the client's EDNS0 buffer size are truncated")
+	mode          = flag.String("mode", "UDP", "DNS mode (UDP, TCP, DoT, DoH)")
+	port          = flag.Int("port", 0, "DNS server port (default: UDP&TCP-53, DoT-853, DoH-443)")
+	cert          = flag.String("cert", "", "Path to certificate file, for DoT or DoH mode")
+	privkey       = flag.String("privkey", "", "Path to private key file, for DoT or DoH mode")
+	unix          = flag.String("unix", "", "Path to Unix socket, only for DoH mode")
+	dnsProxy      = flag.String("proxy", "", "List of proxies for DNS")
+	fallback      = flag.Bool("fallback", false, "Enable fallback")
+	timeout       = flag.Duration("timeout", 5*time.Second, "Query timeout")
+	cacheFile     = flag.String("cache", "", "Path to cache `file` for persistence across restarts")
+	cacheInterval = flag.Duration("cache-interval", 10*time.Minute, "Interval between cache snapshots")
+	stale         = flag.Bool("stale", false, "Keep expired entries loaded from cache file as stale")
+	logPath       = flag.String("log", "", "Path to log file")
+	debug         = flag.Bool("debug", false, "debug")
 )
 
 func init() {
@@ -37,6 +76,7 @@ func init() {
 	svc.Desc = "Instance to serve DNSHub"
 	svc.Exec = run
 	svc.TestExec = test
+	svc.Kill = kill
 	svc.Options = service.Options{
 		Dependencies: []string{"Wants=network-online.target", "After=network.target"},
 	}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// Clients are rate limited by prefix, as BIND does.
+const (
+	ipv4Prefix = 24
+	ipv6Prefix = 56
+)
+
+var (
+	rateDropped = expvar.NewInt("ratelimit_dropped")
+	rrlDropped  = expvar.NewInt("rrl_dropped")
+	rrlSlipped  = expvar.NewInt("rrl_slipped")
+)
+
+var (
+	queryLimiter    *limiter
+	responseLimiter *limiter
+)
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+// limiter is a set of token buckets by key.
+type limiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = max(1, int(rate))
+	}
+	l := &limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+	go func() {
+		for range time.Tick(time.Minute) {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+// allow takes a token from the bucket of key. If there is none, it returns
+// false with the number of times the bucket was denied in a row.
+func (l *limiter) allow(key string) (bool, int) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		b.dropped++
+		return false, b.dropped
+	}
+	b.tokens--
+	b.dropped = 0
+	return true, 0
+}
+
+// sweep removes buckets which are full again.
+func (l *limiter) sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func initRateLimit(rate float64, burst int, rrl float64) {
+	if rate > 0 {
+		svc.Debug("rate limit", "qps", rate, "burst", burst)
+		queryLimiter = newLimiter(rate, burst)
+	}
+	if rrl > 0 {
+		svc.Debug("response rate limit", "rps", rrl, "slip", *rrlSlip)
+		responseLimiter = newLimiter(rrl, 0)
+	}
+}
+
+func clientPrefix(ip netip.Addr) netip.Prefix {
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, ipv4Prefix).Masked()
+	}
+	return netip.PrefixFrom(ip, ipv6Prefix).Masked()
+}
+
+// rateHandler limits the queries of each client prefix. Limited queries are
+// dropped on UDP and answered with REFUSED otherwise, or with BADCOOKIE if
+// they have a client cookie. Responses on UDP are limited by responseLimiter.
+// Clients with a valid server cookie are not limited.
+type rateHandler struct {
+	dns.Handler
+}
+
+func (h rateHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	ip := remoteAddr(w)
+	if !ip.IsValid() || (queryLimiter == nil && responseLimiter == nil) || hasValidCookie(w, r) {
+		h.Handler.ServeDNS(ctx, w, r)
+		return
+	}
+	prefix := clientPrefix(ip)
+	if queryLimiter != nil {
+		if ok, _ := queryLimiter.allow(prefix.String()); !ok {
+			rateDropped.Add(1)
+			svc.Debug("rate limited", "remote", ip, "id", r.ID, "question", r.Question)
+			if !writeBadCookie(w, r) && !isUDP(w) {
+				writeRcode(w, r, dns.RcodeRefused)
+			}
+			return
+		}
+	}
+	if responseLimiter != nil && isUDP(w) {
+		w = rrlWriter(w, r, prefix)
+	}
+	h.Handler.ServeDNS(ctx, w, r)
+}
+
+// udpWriter passes the UDP responses written to it through filter, a nil
+// result drops the response. The connection is hidden from Msg.WriteTo so that
+// responses go through Write.
+type udpWriter struct {
+	dns.ResponseWriter
+	filter func([]byte) []byte
+}
+
+func (w *udpWriter) Conn() net.Conn { return struct{ net.Conn }{w.ResponseWriter.Conn()} }
+
+func (w *udpWriter) Write(p []byte) (int, error) {
+	// Msg.WriteTo prefixes the message with its length as for TCP
+	if len(p) < 2 {
+		return 0, io.ErrShortWrite
+	}
+	m := &dns.Msg{Data: w.filter(p[2:])}
+	if m.Data == nil {
+		return len(p), nil
+	}
+	if _, err := m.WriteTo(w.ResponseWriter); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// rrlWriter returns a writer limiting identical responses to a client prefix,
+// see BIND response rate limiting. Every -rrl-slip limited response is sent
+// truncated to let real clients retry over TCP, the others are dropped.
+func rrlWriter(w dns.ResponseWriter, r *dns.Msg, prefix netip.Prefix) dns.ResponseWriter {
+	question := r.Question
+	return &udpWriter{w, func(p []byte) []byte {
+		if len(p) < 4 || len(question) == 0 {
+			return p
+		}
+		rcode := uint16(p[3] & 0xf)
+		key := prefix.String() + "/" + strconv.Itoa(int(rcode))
+		switch q := question[0]; rcode {
+		case dns.RcodeSuccess:
+			key += "/" + dnsutil.Canonical(q.Header().Name) + "/" + dnsutil.TypeToString(dns.RRToType(q))
+		case dns.RcodeNameError:
+			// random subdomains of a name count as the same response
+			name := dnsutil.Canonical(q.Header().Name)
+			if off, end := dnsutil.Next(name, 0); !end {
+				name = name[off:]
+			}
+			key += "/" + name
+		}
+		ok, n := responseLimiter.allow(key)
+		if ok {
+			return p
+		}
+		if slip := *rrlSlip; slip > 0 && n%slip == 0 {
+			rrlSlipped.Add(1)
+			svc.Debug("response rate limited, slip", "remote", remoteAddr(w), "question", question)
+			m := &dns.Msg{MsgHeader: dns.MsgHeader{ID: r.ID, Response: true, Opcode: r.Opcode, RecursionDesired: r.RecursionDesired, Truncated: true}, Question: question}
+			if err := m.Pack(); err != nil {
+				return nil
+			}
+			return m.Data
+		}
+		rrlDropped.Add(1)
+		svc.Debug("response rate limited, drop", "remote", remoteAddr(w), "question", question)
+		return nil
+	}}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/sunshineplan/utils/txt"
+)
+
+const (
+	// serverTimeout is the time to wait for one authoritative server.
+	serverTimeout = 2 * time.Second
+	maxCutTTL     = 24 * time.Hour
+	// maxQueries limits the queries sent for one resolution, including the
+	// queries for the addresses of name servers.
+	maxQueries = 100
+	// maxDepth limits the nesting of name server address lookups.
+	maxDepth = 6
+	// maxMinimise is the number of labels after which the full name is
+	// queried, see MAX_MINIMISE_COUNT of RFC 9156.
+	maxMinimise = 10
+)
+
+// defaultRootHints are the IPv4 addresses of the root servers.
+var defaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10", "192.5.5.241", "192.112.36.4",
+	"198.97.190.53", "192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+var errLoop = errors.New("too many queries or referrals")
+
+// zoneCut is a delegation learned from a referral.
+type zoneCut struct {
+	zone    string
+	expire  time.Time
+	mu      sync.Mutex
+	servers []string // addresses of the name servers
+	names   []string // name servers without known address
+}
+
+func (z *zoneCut) get() ([]string, []string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return slices.Clone(z.servers), slices.Clone(z.names)
+}
+
+// resolved records the addresses found for the name server without glue.
+func (z *zoneCut) resolved(name string, addrs []string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.names = slices.DeleteFunc(z.names, func(i string) bool { return i == name })
+	z.servers = append(z.servers, addrs...)
+}
+
+// recursor resolves queries iteratively starting from the root hints.
+type recursor struct {
+	*dns.Client
+	root *zoneCut
+	port string // port of the name servers below the root
+	mu   sync.Mutex
+	cuts map[string]*zoneCut
+}
+
+var rootRecursor = sync.OnceValue(func() *recursor { return newRecursor(*rootHints) })
+
+func newRecursor(file string) *recursor {
+	root := &zoneCut{zone: "."}
+	for _, i := range defaultRootHints {
+		root.servers = append(root.servers, net.JoinHostPort(i, "53"))
+	}
+	port := "53"
+	if file != "" {
+		if hints, err := loadRootHints(file); err != nil {
+			svc.Error("failed to load root hints", "file", file, "error", err)
+		} else {
+			// a local hierarchy listens on the port of its root
+			root.servers = hints
+			_, port, _ = net.SplitHostPort(hints[0])
+		}
+	}
+	svc.Debug("root hints", "servers", root.servers, "port", port)
+	c := &recursor{Client: dns.NewClient(), root: root, port: port, cuts: make(map[string]*zoneCut)}
+	go func() {
+		for range time.Tick(time.Minute) {
+			c.sweep()
+		}
+	}()
+	return c
+}
+
+// loadRootHints reads the addresses of the root servers from a root hints
+// file as named.root, or given as address[:port] lines.
+func loadRootHints(file string) ([]string, error) {
+	rows, err := txt.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var servers, ns []string
+	addrs := make(map[string][]string)
+	for line, i := range rows {
+		s, _, _ := strings.Cut(i, ";")
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddrPort(s); err == nil {
+			servers = append(servers, addr.String())
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			servers = append(servers, net.JoinHostPort(addr.String(), "53"))
+			continue
+		}
+		rr, err := dns.New(s)
+		if err != nil {
+			svc.Error("illegal root hint", "file", file, "line", line+1, "row", i, "error", err)
+			continue
+		}
+		name := dnsutil.Canonical(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if name == "." {
+				ns = append(ns, dnsutil.Canonical(rr.Ns))
+			}
+		case *dns.A:
+			addrs[name] = append(addrs[name], net.JoinHostPort(rr.Addr.String(), "53"))
+		case *dns.AAAA:
+			addrs[name] = append(addrs[name], net.JoinHostPort(rr.Addr.String(), "53"))
+		}
+	}
+	for _, i := range ns {
+		servers = append(servers, addrs[i]...)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no root server address found")
+	}
+	return servers, nil
+}
+
+func (c *recursor) sweep() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for zone, cut := range c.cuts {
+		if now.After(cut.expire) {
+			delete(c.cuts, zone)
+		}
+	}
+}
+
+// closest returns the closest known zone cut above name. For DS queries name
+// itself is skipped, as DS records are served by the parent.
+func (c *recursor) closest(name string, t uint16) *zoneCut {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, i := range ancestors(name) {
+		if t == dns.TypeDS && i == name {
+			continue
+		}
+		if cut, ok := c.cuts[i]; ok && now.Before(cut.expire) {
+			return cut
+		}
+	}
+	return c.root
+}
+
+// resolution is the state of one resolution shared by its nested lookups.
+type resolution struct {
+	do      bool
+	queries int
+}
+
+func (c *recursor) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	svc.Debug("recursive", "request", m.Question)
+	q := m.Question[0]
+	r, err := c.resolve(ctx, dnsutil.Canonical(q.Header().Name), dns.RRToType(q), &resolution{do: m.Security}, 0)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	dnsutil.SetReply(reply, m)
+	reply.RecursionAvailable = true
+	reply.Rcode = r.Rcode
+	reply.Answer, reply.Ns = r.Answer, r.Ns
+	return reply, nil
+}
+
+func (*recursor) Name() string {
+	return "recursive"
+}
+
+// resolve looks up name and t following CNAME records.
+func (c *recursor) resolve(ctx context.Context, name string, t uint16, res *resolution, depth int) (*dns.Msg, error) {
+	var chain []dns.RR
+	for range maxCNAME {
+		r, err := c.lookup(ctx, name, t, res, depth)
+		if err != nil {
+			return nil, err
+		}
+		r.Answer = slices.Concat(chain, r.Answer)
+		if r.Rcode != dns.RcodeSuccess || t == dns.TypeCNAME {
+			return r, nil
+		}
+		target := cnameTarget(r.Answer, name, t)
+		if target == "" {
+			return r, nil
+		}
+		chain, name = r.Answer, target
+	}
+	return nil, errLoop
+}
+
+// cnameTarget follows the CNAME records of rrs from name and returns the
+// target which is left to be resolved, if any.
+func cnameTarget(rrs []dns.RR, name string, t uint16) string {
+	var target string
+	for range maxCNAME {
+		var next string
+		for _, rr := range rrs {
+			if dnsutil.Canonical(rr.Header().Name) != name {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				next = dnsutil.Canonical(rr.Target)
+			default:
+				if dns.RRToType(rr) == t {
+					return ""
+				}
+			}
+		}
+		if next == "" {
+			return target
+		}
+		name, target = next, next
+	}
+	return target
+}
+
+// lookup queries the authoritative servers of name, starting from the closest
+// known zone cut and following referrals downward. Names below the zone cut
+// are queried one label at a time, see RFC 9156.
+func (c *recursor) lookup(ctx context.Context, name string, t uint16, res *resolution, depth int) (*dns.Msg, error) {
+	cut := c.closest(name, t)
+	cur := cut.zone
+	for minimise := 0; ; minimise++ {
+		qname, qtype := name, t
+		if cur != name && minimise < maxMinimise {
+			qname = childName(cur, name)
+			if qname != name {
+				qtype = dns.TypeA
+			}
+		}
+		r, err := c.query(ctx, cut, qname, qtype, res, depth)
+		if err != nil {
+			if qname != name && !errors.Is(err, errLoop) {
+				// some servers fail minimised queries
+				cur = name
+				continue
+			}
+			return nil, err
+		}
+		if zone, ok := referral(r, cut.zone, name); ok && !(t == dns.TypeDS && zone == name) {
+			svc.Debug("referral", "zone", zone, "question", name)
+			cut = c.store(r, cut.zone, zone)
+			cur = zone
+			continue
+		}
+		if qname == name {
+			r.Answer = inBailiwick(r.Answer, cut.zone)
+			r.Ns = inBailiwick(r.Ns, cut.zone)
+			return r, nil
+		}
+		switch {
+		case r.Rcode == dns.RcodeNameError:
+			// nothing exists below a nonexistent name, see RFC 8020
+			r.Answer = nil
+			r.Ns = inBailiwick(r.Ns, cut.zone)
+			return r, nil
+		case slices.ContainsFunc(r.Answer, func(rr dns.RR) bool {
+			t := dns.RRToType(rr)
+			return t == dns.TypeCNAME || t == dns.TypeDNAME
+		}):
+			// aliases must be resolved with the full name
+			cur = name
+		default:
+			cur = qname
+		}
+	}
+}
+
+// childName returns the ancestor of name one label below zone.
+func childName(zone, name string) string {
+	var off int
+	for range dnsutil.Labels(name) - dnsutil.Labels(zone) - 1 {
+		off, _ = dnsutil.Next(name, off)
+	}
+	return name[off:]
+}
+
+// referral returns the zone delegated by r, which must be below zone and
+// above or at name.
+func referral(r *dns.Msg, zone, name string) (string, bool) {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 || r.Authoritative {
+		return "", false
+	}
+	for _, rr := range r.Ns {
+		if _, ok := rr.(*dns.NS); ok {
+			cut := dnsutil.Canonical(rr.Header().Name)
+			if cut != zone && dnsutil.IsBelow(zone, cut) && dnsutil.IsBelow(cut, name) {
+				return cut, true
+			}
+		}
+	}
+	return "", false
+}
+
+// lame reports whether r is useless, as an error or a referral upward or
+// sideways.
+func lame(r *dns.Msg, zone string) bool {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return true
+	}
+	if r.Authoritative || len(r.Answer) > 0 {
+		return false
+	}
+	for _, rr := range r.Ns {
+		if _, ok := rr.(*dns.NS); ok {
+			cut := dnsutil.Canonical(rr.Header().Name)
+			if cut == zone || !dnsutil.IsBelow(zone, cut) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func inBailiwick(rrs []dns.RR, zone string) []dns.RR {
+	return slices.DeleteFunc(rrs, func(rr dns.RR) bool { return !dnsutil.IsBelow(zone, dnsutil.Canonical(rr.Header().Name)) })
+}
+
+// store caches the zone cut of the referral r sent by a server of parent. Glue
+// is only accepted within parent.
+func (c *recursor) store(r *dns.Msg, parent, zone string) *zoneCut {
+	cut := &zoneCut{zone: zone}
+	ttl := uint32(maxCutTTL / time.Second)
+	for _, rr := range r.Ns {
+		if ns, ok := rr.(*dns.NS); ok && dnsutil.Canonical(ns.Hdr.Name) == zone {
+			ttl = min(ttl, ns.Hdr.TTL)
+			name := dnsutil.Canonical(ns.Ns)
+			var glue bool
+			for _, rr := range r.Extra {
+				if dnsutil.Canonical(rr.Header().Name) != name || !dnsutil.IsBelow(parent, name) {
+					continue
+				}
+				switch rr := rr.(type) {
+				case *dns.A:
+					cut.servers, glue = append(cut.servers, net.JoinHostPort(rr.Addr.String(), c.port)), true
+				case *dns.AAAA:
+					cut.servers, glue = append(cut.servers, net.JoinHostPort(rr.Addr.String(), c.port)), true
+				}
+			}
+			if !glue {
+				cut.names = append(cut.names, name)
+			}
+		}
+	}
+	cut.expire = time.Now().Add(time.Duration(ttl) * time.Second)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cuts[zone] = cut
+	return cut
+}
+
+// query sends the question to the servers of cut until one gives a usable
+// response. Name servers without glue are resolved when needed.
+func (c *recursor) query(ctx context.Context, cut *zoneCut, name string, t uint16, res *resolution, depth int) (*dns.Msg, error) {
+	servers, names := cut.get()
+	rand.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+	err := errors.New("no name server of " + cut.zone + " answered")
+	try := func(servers []string) (*dns.Msg, error) {
+		for _, addr := range servers {
+			if res.queries++; res.queries > maxQueries {
+				return nil, errLoop
+			}
+			r, e := c.exchange(ctx, name, t, res.do, addr)
+			if e != nil {
+				svc.Debug("recursive query failed", "server", addr, "question", name, "error", e)
+				err = e
+				continue
+			}
+			if lame(r, cut.zone) {
+				svc.Debug("lame response", "server", addr, "zone", cut.zone, "question", name, "rcode", dnsutil.RcodeToString(r.Rcode))
+				continue
+			}
+			return r, nil
+		}
+		return nil, nil
+	}
+	if r, e := try(servers); r != nil || e != nil {
+		return r, e
+	}
+	if depth >= maxDepth {
+		return nil, errLoop
+	}
+	for _, ns := range names {
+		addrs, e := c.addrs(ctx, ns, res, depth+1)
+		if e != nil {
+			if errors.Is(e, errLoop) {
+				return nil, e
+			}
+			err = e
+			continue
+		}
+		cut.resolved(ns, addrs)
+		if r, e := try(addrs); r != nil || e != nil {
+			return r, e
+		}
+	}
+	return nil, err
+}
+
+// addrs resolves the addresses of a name server.
+func (c *recursor) addrs(ctx context.Context, name string, res *resolution, depth int) ([]string, error) {
+	var addrs []string
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, err := c.resolve(ctx, name, t, res, depth)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.JoinHostPort(rr.Addr.String(), c.port))
+			case *dns.AAAA:
+				addrs = append(addrs, net.JoinHostPort(rr.Addr.String(), c.port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, errors.New("no address of name server " + name)
+}
+
+// exchange sends a non-recursive query to addr, retrying over TCP if the UDP
+// response is truncated.
+func (c *recursor) exchange(ctx context.Context, name string, t uint16, do bool, addr string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverTimeout)
+	defer cancel()
+	q := dns.NewMsg(name, t)
+	q.RecursionDesired = false
+	q.UDPSize = ednsUDPSize
+	q.Security = do
+	r, _, err := c.Exchange(ctx, q, "udp", addr)
+	if err == nil && r.Truncated {
+		svc.Debug("truncated, retry over TCP", "server", addr, "question", name)
+		r, _, err = c.Exchange(ctx, q, "tcp", addr)
+	}
+	return r, err
+}
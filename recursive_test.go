@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// testServers is a root, TLD and leaf hierarchy. leaf.test. is delegated to
+// a name server of tld. without glue.
+var testServers = map[string][]string{
+	"127.0.0.2": {
+		". 86400 IN SOA a.root. admin.root. 1 3600 600 86400 300",
+		"test. 86400 IN NS ns.tld.",
+		"tld. 86400 IN NS ns.tld.",
+		"ns.tld. 86400 IN A 127.0.0.3",
+	},
+	"127.0.0.3": {
+		"test. 3600 IN SOA ns.tld. admin.tld. 1 3600 600 86400 300",
+		"leaf.test. 3600 IN NS ns.leaf.tld.",
+		"tld. 3600 IN SOA ns.tld. admin.tld. 1 3600 600 86400 300",
+		"ns.tld. 3600 IN A 127.0.0.3",
+		"ns.leaf.tld. 3600 IN A 127.0.0.4",
+	},
+	"127.0.0.4": {
+		"leaf.test. 3600 IN SOA ns.leaf.tld. admin.tld. 1 3600 600 86400 300",
+		"www.a.b.leaf.test. 300 IN A 192.0.2.1",
+	},
+}
+
+// testQuery is a query received by a test server.
+type testQuery struct {
+	server, network, name string
+}
+
+type testHierarchy struct {
+	mu      sync.Mutex
+	queries []testQuery
+}
+
+func (h *testHierarchy) received(server string) (queries []testQuery) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, i := range h.queries {
+		if i.server == server {
+			queries = append(queries, i)
+		}
+	}
+	return
+}
+
+// handler answers as the authoritative server of the zones of rrs: a
+// referral for names below a delegation, else the records asked for, NODATA
+// or NXDOMAIN. UDP queries for big.leaf.test. are truncated.
+func (h *testHierarchy) handler(server string, rrs []dns.RR) dns.HandlerFunc {
+	return func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		name, t := dnsutil.Canonical(q.Header().Name), dns.RRToType(q)
+		_, udp := w.LocalAddr().(*net.UDPAddr)
+		h.mu.Lock()
+		h.queries = append(h.queries, testQuery{server, w.LocalAddr().Network(), name})
+		h.mu.Unlock()
+
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, r)
+		var zone string
+		for _, rr := range rrs {
+			if owner := rr.Header().Name; dns.RRToType(rr) == dns.TypeSOA && dnsutil.IsBelow(owner, name) && len(owner) > len(zone) {
+				zone = owner
+			}
+		}
+		var cut string
+		for _, rr := range rrs {
+			if owner := rr.Header().Name; dns.RRToType(rr) == dns.TypeNS && owner != zone &&
+				dnsutil.IsBelow(zone, owner) && dnsutil.IsBelow(owner, name) && len(owner) > len(cut) {
+				cut = owner
+			}
+		}
+		if cut != "" {
+			for _, rr := range rrs {
+				if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == cut {
+					m.Ns = append(m.Ns, ns)
+					for _, glue := range rrs {
+						if glue.Header().Name == ns.Ns && dns.RRToType(glue) == dns.TypeA {
+							m.Extra = append(m.Extra, glue)
+						}
+					}
+				}
+			}
+			m.WriteTo(w)
+			return
+		}
+		m.Authoritative = true
+		var exists bool
+		for _, rr := range rrs {
+			if owner := rr.Header().Name; owner == name && dns.RRToType(rr) == t {
+				m.Answer = append(m.Answer, rr)
+			} else if dnsutil.IsBelow(name, owner) {
+				exists = true
+			}
+		}
+		if name == "big.leaf.test." && t == dns.TypeTXT {
+			if m.Truncated = udp; !udp {
+				for i := range 100 {
+					rr, _ := dns.New(fmt.Sprintf("big.leaf.test. 300 IN TXT \"record %d\"", i))
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+			m.WriteTo(w)
+			return
+		}
+		if len(m.Answer) == 0 {
+			if !exists {
+				m.Rcode = dns.RcodeNameError
+			}
+			for _, rr := range rrs {
+				if rr.Header().Name == zone && dns.RRToType(rr) == dns.TypeSOA {
+					m.Ns = append(m.Ns, rr)
+				}
+			}
+		}
+		m.WriteTo(w)
+	}
+}
+
+// listen starts the servers of testServers on a port shared by them.
+func (h *testHierarchy) listen(t *testing.T) string {
+	t.Helper()
+	for range 10 {
+		if port, ok := h.tryListen(t); ok {
+			return port
+		}
+	}
+	t.Skip("no free port on 127.0.0.2-4")
+	return ""
+}
+
+func (h *testHierarchy) tryListen(t *testing.T) (string, bool) {
+	c, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("loopback addresses other than 127.0.0.1 unavailable:", err)
+	}
+	_, port, _ := net.SplitHostPort(c.LocalAddr().String())
+	conns := []io.Closer{c}
+	var servers []*dns.Server
+	for addr, records := range testServers {
+		var rrs []dns.RR
+		for _, i := range records {
+			rr, err := dns.New(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		handler := h.handler(addr, rrs)
+		pc := c
+		if addr != "127.0.0.2" {
+			if pc, err = net.ListenPacket("udp", net.JoinHostPort(addr, port)); err != nil {
+				closeAll(conns)
+				return "", false
+			}
+			conns = append(conns, pc)
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, port))
+		if err != nil {
+			closeAll(conns)
+			return "", false
+		}
+		conns = append(conns, l)
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: handler}, &dns.Server{Listener: l, Handler: handler})
+	}
+	for _, i := range servers {
+		// shutting down a server which is still starting races with it
+		started := make(chan struct{})
+		i.NotifyStartedFunc = func(context.Context) { close(started) }
+		go i.ListenAndServe()
+		<-started
+		t.Cleanup(func() { i.Shutdown(context.Background()) })
+	}
+	return port, true
+}
+
+func closeAll(conns []io.Closer) {
+	for _, i := range conns {
+		i.Close()
+	}
+}
+
+func TestRecursor(t *testing.T) {
+	h := new(testHierarchy)
+	port := h.listen(t)
+	hints := filepath.Join(t.TempDir(), "root.hints")
+	if err := os.WriteFile(hints, []byte("127.0.0.2:"+port+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newRecursor(hints)
+
+	m, err := c.ExchangeContext(t.Context(), dns.NewMsg("www.a.b.leaf.test.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).Addr.String() != "192.0.2.1" {
+		t.Fatalf("expected 192.0.2.1; got %v", m.Answer)
+	}
+	// the root is only asked for the labels below it
+	for _, q := range h.received("127.0.0.2") {
+		if q.name != "test." && q.name != "tld." {
+			t.Errorf("root asked for %s", q.name)
+		}
+	}
+	// the glueless name server is resolved and the leaf asked one label at a
+	// time
+	var names []string
+	for _, q := range h.received("127.0.0.4") {
+		names = append(names, q.name)
+	}
+	if expect := []string{"b.leaf.test.", "a.b.leaf.test.", "www.a.b.leaf.test."}; !slices.Equal(names, expect) {
+		t.Errorf("expected leaf queries %v; got %v", expect, names)
+	}
+
+	m, err = c.ExchangeContext(t.Context(), dns.NewMsg("big.leaf.test.", dns.TypeTXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 100 || m.Truncated {
+		t.Errorf("expected 100 TXT records; got %d, truncated %t", len(m.Answer), m.Truncated)
+	}
+	var networks []string
+	for _, q := range h.received("127.0.0.4") {
+		if q.name == "big.leaf.test." {
+			networks = append(networks, q.network)
+		}
+	}
+	if strings.Join(networks, ",") != "udp,tcp" {
+		t.Errorf("expected big.leaf.test. over udp then tcp; got %v", networks)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+// requestHandler answers requests without exactly one question with FORMERR
+// and requests of opcodes other than QUERY, NOTIFY and UPDATE with NOTIMP.
+// CHAOS queries are answered locally and never forwarded.
+type requestHandler struct {
+	dns.Handler
+}
+
+func (h requestHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 {
+		svc.Debug("malformed request", "remote", w.RemoteAddr(), "id", r.ID, "question", r.Question)
+		writeRcode(w, r, dns.RcodeFormatError)
+		return
+	}
+	switch r.Opcode {
+	case dns.OpcodeQuery, dns.OpcodeNotify, dns.OpcodeUpdate:
+	default:
+		svc.Debug("unsupported opcode", "remote", w.RemoteAddr(), "id", r.ID, "opcode", dnsutil.OpcodeToString(r.Opcode))
+		writeRcode(w, r, dns.RcodeNotImplemented)
+		return
+	}
+	if r.Question[0].Header().Class == dns.ClassCHAOS {
+		answerChaos(w, r)
+		return
+	}
+	h.Handler.ServeDNS(ctx, w, r)
+}
+
+// answerChaos answers the CHAOS TXT queries of the server version and
+// identity, see RFC 4892, from -chaos-version and -chaos-id. Empty ones are
+// hidden and refused like every other CHAOS query.
+func answerChaos(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	var txt string
+	switch dnsutil.Canonical(q.Header().Name) {
+	case "version.bind.", "version.server.":
+		txt = *chaosVersion
+	case "hostname.bind.", "id.server.":
+		txt = *chaosID
+	}
+	if r.Opcode != dns.OpcodeQuery || txt == "" {
+		svc.Debug("refuse CHAOS query", "remote", w.RemoteAddr(), "question", r.Question)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.Authoritative = true
+	if t := dns.RRToType(q); t == dns.TypeTXT || t == dns.TypeANY {
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.Header{Name: q.Header().Name, Class: dns.ClassCHAOS},
+			TXT: rdata.TXT{Txt: []string{txt}},
+		}}
+	}
+	m.WriteTo(w)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsconf"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+var errNoNameserver = errors.New("no system nameserver found")
+
+// platformTTL is the TTL of addresses looked up by the platform resolver,
+// which does not tell them.
+const platformTTL = 60
+
+var defaultResolver = new(resolver)
+
+// resolver is the system DNS, the nameservers of resolv.conf queried with the
+// search, ndots, timeout, attempts, rotate and use-vc settings of it. The file
+// is reloaded when changed. Without it, as on Windows, A and AAAA queries are
+// looked up by the platform resolver.
+type resolver struct {
+	once sync.Once
+	conf atomic.Pointer[systemConfig]
+	next atomic.Uint32
+}
+
+type systemConfig struct {
+	*dnsconf.Config
+	servers []*client
+}
+
+func loadResolvConf(file string) (*systemConfig, error) {
+	conf, err := dnsconf.FromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Servers) == 0 {
+		return nil, errNoNameserver
+	}
+	network := conf.Network
+	if network == "" {
+		network = "udp"
+	}
+	c := &systemConfig{Config: conf}
+	for _, i := range conf.Servers {
+		c.servers = append(c.servers, &client{network, net.JoinHostPort(i, conf.Port), dns.NewClient(), nil})
+	}
+	svc.Debug("system DNS", "servers", conf.Servers, "search", conf.Search, "ndots", conf.Ndots, "rotate", conf.Rotate)
+	return c, nil
+}
+
+// config returns the system DNS settings, loading them on first use.
+func (r *resolver) config() *systemConfig {
+	r.once.Do(func() {
+		load := func() {
+			c, err := loadResolvConf(*resolvConf)
+			if err != nil {
+				svc.Error("failed to load system DNS", "file", *resolvConf, "error", err)
+				return
+			}
+			r.conf.Store(c)
+		}
+		if _, err := os.Stat(*resolvConf); errors.Is(err, fs.ErrNotExist) {
+			svc.Debug("no system DNS file, use platform resolver", "file", *resolvConf)
+			return
+		}
+		load()
+		if err := watchPaths([]string{*resolvConf}, "", func() {
+			svc.Print("reload system DNS ", *resolvConf)
+			load()
+		}); err != nil {
+			svc.Error("failed to watch system DNS", "file", *resolvConf, "error", err)
+		}
+	})
+	return r.conf.Load()
+}
+
+// ExchangeContext sends m to the system nameservers. Names below the search
+// domains are tried as resolv.conf tells, answers for them are given by a
+// CNAME from the name asked.
+func (r *resolver) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	conf := r.config()
+	if conf == nil {
+		return lookupIP(ctx, m)
+	}
+	svc.Debug("system DNS", "request", m.Question)
+	q := m.Question[0]
+	name := q.Header().Name
+	names := []string{name}
+	if len(conf.Search) > 0 && name != "." {
+		names = conf.NameList(strings.TrimSuffix(name, "."))
+	}
+	var asked *dns.Msg
+	for i, n := range names {
+		query := m
+		if !strings.EqualFold(n, name) {
+			rr := q.Clone()
+			rr.Header().Name = n
+			query = &dns.Msg{MsgHeader: m.MsgHeader, Question: []dns.RR{rr}, Pseudo: m.Pseudo}
+		}
+		res, err := r.exchange(ctx, conf, query)
+		if err != nil {
+			return nil, err
+		}
+		if query == m {
+			asked = res
+		}
+		if res.Rcode == dns.RcodeNameError && i < len(names)-1 {
+			continue
+		}
+		if query == m || (res.Rcode == dns.RcodeNameError && asked != nil) {
+			return asked, nil
+		}
+		reply := new(dns.Msg)
+		dnsutil.SetReply(reply, m)
+		reply.RecursionAvailable = res.RecursionAvailable
+		reply.Rcode = res.Rcode
+		if res.Rcode == dns.RcodeSuccess {
+			cname := &dns.CNAME{Hdr: dns.Header{Name: name, Class: q.Header().Class}, CNAME: rdata.CNAME{Target: n}}
+			if len(res.Answer) > 0 {
+				cname.Hdr.TTL = res.Answer[0].Header().TTL
+			}
+			reply.Answer = append([]dns.RR{cname}, res.Answer...)
+		}
+		reply.Ns = res.Ns
+		svc.Debug("system DNS search", "question", m.Question, "name", n)
+		return reply, nil
+	}
+	return nil, errNoNameserver
+}
+
+// exchange sends m to the nameservers in turn, starting from the next one if
+// rotate is set, until one answers other than SERVFAIL or REFUSED. The last
+// answer is returned if none does.
+func (r *resolver) exchange(ctx context.Context, conf *systemConfig, m *dns.Msg) (last *dns.Msg, err error) {
+	var start int
+	if conf.Rotate {
+		start = int(r.next.Add(1))
+	}
+	for range conf.Attempts {
+		for i := range conf.servers {
+			c := conf.servers[(start+i)%len(conf.servers)]
+			tctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeout)*time.Second)
+			var res *dns.Msg
+			res, err = c.ExchangeContext(tctx, m)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				svc.Debug("system DNS failed", "DNS", c.address, "request", m.Question, "error", err)
+				continue
+			}
+			if res.Rcode != dns.RcodeServerFailure && res.Rcode != dns.RcodeRefused {
+				return res, nil
+			}
+			svc.Debug("system DNS failed", "DNS", c.address, "request", m.Question, "rcode", dnsutil.RcodeToString(res.Rcode))
+			last = res
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+// lookupIP answers the A and AAAA queries m with the platform resolver.
+func lookupIP(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	q := m.Question[0]
+	var network string
+	switch dns.RRToType(q) {
+	case dns.TypeA:
+		network = "ip4"
+	case dns.TypeAAAA:
+		network = "ip6"
+	default:
+		return nil, errNoNameserver
+	}
+	svc.Debug("platform resolver", "request", m.Question)
+	reply := new(dns.Msg)
+	dnsutil.SetReply(reply, m)
+	reply.RecursionAvailable = true
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, network, strings.TrimSuffix(q.Header().Name, "."))
+	if err != nil {
+		// names without addresses of the family cannot be told from names
+		// which do not exist, so both get NODATA
+		if dnsErr, ok := errors.AsType[*net.DNSError](err); ok && dnsErr.IsNotFound {
+			return reply, nil
+		}
+		return nil, err
+	}
+	hdr := dns.Header{Name: q.Header().Name, Class: dns.ClassINET, TTL: platformTTL}
+	for _, ip := range ips {
+		if ip = ip.Unmap(); ip.Is4() {
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: rdata.A{Addr: ip}})
+		} else {
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: rdata.AAAA{Addr: ip}})
+		}
+	}
+	return reply, nil
+}
+
+func (*resolver) Name() string {
+	return "system"
+}
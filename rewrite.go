@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+	"codeberg.org/miekg/dns/svcb"
+	"github.com/sunshineplan/utils/txt"
+)
+
+// rewriteTTL is the TTL of records synthesized by rewrite rules.
+const rewriteTTL = 300
+
+// rewriteRule is a rule of the rewrite file:
+//
+//	pattern [qtype] action [arguments]
+//
+// Pattern is a domain name, or *.domain for all names below domain. Actions
+// cname, answer and rcode answer matching queries without forwarding them,
+// actions remove and ttl modify the answers.
+type rewriteRule struct {
+	name     string
+	wildcard bool
+	qType    uint16
+	action   string
+
+	target string // cname
+	rr     dns.RR // answer
+	rType  uint16 // remove
+	key    uint16 // remove, parameter of HTTPS and SVCB records
+	ttl    uint32 // ttl
+	rcode  uint16 // rcode
+}
+
+var rewriteActions = map[string]bool{"cname": true, "answer": true, "remove": true, "ttl": true, "rcode": true}
+
+func (rule *rewriteRule) match(r *dns.Msg) bool {
+	if qType := dns.RRToType(r.Question[0]); rule.qType != 0 && qType != dns.TypeANY && rule.qType != qType {
+		return false
+	}
+	return rule.matchName(r.Question[0].Header().Name)
+}
+
+func (rule *rewriteRule) matchName(name string) bool {
+	name = dnsutil.Canonical(name)
+	if rule.wildcard {
+		return name != rule.name && dnsutil.IsBelow(rule.name, name)
+	}
+	return name == rule.name
+}
+
+func (rule *rewriteRule) modify() bool {
+	return rule.action == "remove" || rule.action == "ttl"
+}
+
+type rewriteRules []*rewriteRule
+
+var currentRewrite atomic.Pointer[rewriteRules]
+
+func getRewrite(p *atomic.Pointer[rewriteRules]) rewriteRules {
+	if rules := p.Load(); rules != nil {
+		return *rules
+	}
+	return nil
+}
+
+// query answers r by the first matching cname, answer or rcode rule, resolving
+// CNAME targets with lookup. Queries without such rule are passed to lookup.
+func (rules rewriteRules) query(r *dns.Msg, lookup func(*dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	var rule *rewriteRule
+	for _, i := range rules {
+		if !i.modify() && i.match(r) {
+			rule = i
+			break
+		}
+	}
+	q := r.Question[0]
+	qType := dns.RRToType(q)
+	if rule == nil {
+		// HTTPS and SVCB records of names with rewritten addresses would give
+		// clients the original addresses as hints, so they are answered with
+		// NODATA instead
+		if (qType != dns.TypeHTTPS && qType != dns.TypeSVCB) || !rules.rewritesAddress(q.Header().Name) {
+			return lookup(r)
+		}
+	}
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.RecursionAvailable = true
+	if rule == nil {
+		svc.Debug("rewrite", "question", r.Question, "action", "nodata")
+		return m, nil
+	}
+	svc.Debug("rewrite", "question", r.Question, "action", rule.action)
+
+	switch rule.action {
+	case "rcode":
+		m.Rcode = rule.rcode
+	case "answer":
+		// all matching answer rules make up the answer
+		for _, i := range rules {
+			if i.action != "answer" || !i.match(r) {
+				continue
+			}
+			if t := dns.RRToType(i.rr); qType == t || qType == dns.TypeANY {
+				rr := i.rr.Clone()
+				rr.Header().Name = q.Header().Name
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	case "cname":
+		m.Answer = []dns.RR{&dns.CNAME{
+			Hdr:   dns.Header{Name: q.Header().Name, Class: dns.ClassINET, TTL: rewriteTTL},
+			CNAME: rdata.CNAME{Target: rule.target},
+		}}
+		if qType == dns.TypeCNAME {
+			break
+		}
+		t := dns.NewMsg(rule.target, qType)
+		t.RecursionDesired = r.RecursionDesired
+		res, err := lookup(t)
+		if err != nil {
+			return nil, err
+		}
+		m.Rcode = res.Rcode
+		m.Answer = append(m.Answer, res.Answer...)
+		m.Ns = res.Ns
+	}
+	return m, nil
+}
+
+// rewritesAddress reports whether A or AAAA records of name are answered by
+// rewrite rules.
+func (rules rewriteRules) rewritesAddress(name string) bool {
+	for _, i := range rules {
+		if i.action == "answer" && i.matchName(name) {
+			if t := dns.RRToType(i.rr); t == dns.TypeA || t == dns.TypeAAAA {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answer applies the matching remove and ttl rules to m, the answer to r.
+// Records are copied before modified as m may share them with the cache.
+func (rules rewriteRules) answer(r, m *dns.Msg) *dns.Msg {
+	for _, rule := range rules {
+		if !rule.modify() || !rule.match(r) {
+			continue
+		}
+		svc.Debug("rewrite", "question", r.Question, "action", rule.action)
+		m = m.Copy()
+		m.Data = nil
+		switch rule.action {
+		case "remove":
+			if rule.rType == 0 {
+				var answer, extra bool
+				m.Answer, answer = removeParam(m.Answer, rule.key)
+				m.Extra, extra = removeParam(m.Extra, rule.key)
+				if answer || extra {
+					m.AuthenticatedData = false
+				}
+				break
+			}
+			answer, extra := removeType(m.Answer, rule.rType), removeType(m.Extra, rule.rType)
+			if len(answer) != len(m.Answer) || len(extra) != len(m.Extra) {
+				// what is left is no longer what was validated
+				m.AuthenticatedData = false
+			}
+			m.Answer, m.Extra = answer, extra
+			// address hints of the removed family go as well
+			var hints bool
+			switch rule.rType {
+			case dns.TypeA:
+				m.Answer, hints = removeParam(m.Answer, svcb.KeyIPv4Hint)
+			case dns.TypeAAAA:
+				m.Answer, hints = removeParam(m.Answer, svcb.KeyIPv6Hint)
+			}
+			if hints {
+				m.AuthenticatedData = false
+			}
+		case "ttl":
+			answer := make([]dns.RR, len(m.Answer))
+			for i, rr := range m.Answer {
+				answer[i] = rr.Clone()
+				answer[i].Header().TTL = rule.ttl
+			}
+			m.Answer = answer
+		}
+	}
+	return m
+}
+
+// removeType returns a copy of rrs without records of type t and the RRSIG
+// records covering them.
+func removeType(rrs []dns.RR, t uint16) (res []dns.RR) {
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			continue
+		}
+		if dns.RRToType(rr) != t {
+			res = append(res, rr)
+		}
+	}
+	return
+}
+
+// initRewrite loads the rewrite rules file into p and reloads it when changed.
+func initRewrite(file string, p *atomic.Pointer[rewriteRules]) {
+	if file == "" {
+		return
+	}
+	load := func() {
+		rules, err := loadRewrite(file)
+		if err != nil {
+			svc.Error("failed to load rewrite rules", "error", err)
+			return
+		}
+		p.Store(&rules)
+	}
+	load()
+	if err := watchPaths([]string{file}, "", func() {
+		svc.Print("reload rewrite rules ", file)
+		load()
+	}); err != nil {
+		svc.Error("failed to watch rewrite rules", "error", err)
+	}
+}
+
+func loadRewrite(file string) (rules rewriteRules, err error) {
+	rows, err := txt.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for line, i := range rows {
+		if n := strings.IndexRune(i, '#'); n != -1 {
+			i = i[:n]
+		}
+		fields := strings.Fields(i)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseRewriteRule(fields)
+		if err != nil {
+			svc.Error("illegal rewrite rule", "file", file, "line", line+1, "rule", i, "error", err)
+			continue
+		}
+		svc.Debug("rewrite rule", "rule", i)
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func parseRewriteRule(fields []string) (*rewriteRule, error) {
+	if len(fields) < 3 {
+		return nil, errors.New("rewrite rule must be set as pattern [qtype] action [arguments]")
+	}
+	rule := new(rewriteRule)
+	rule.name, rule.wildcard = strings.CutPrefix(dnsutil.Canonical(fields[0]), "*.")
+	if !rewriteActions[strings.ToLower(fields[1])] {
+		t, err := dnsutil.StringToType(strings.ToUpper(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < 4 {
+			return nil, errors.New("rewrite rule must be set as pattern [qtype] action [arguments]")
+		}
+		rule.qType, fields = t, fields[1:]
+	}
+	rule.action, fields = strings.ToLower(fields[1]), fields[2:]
+	switch rule.action {
+	case "cname":
+		rule.target = dnsutil.Fqdn(fields[0])
+	case "answer":
+		rr, err := dns.New(fmt.Sprintf(". %d IN %s", rewriteTTL, strings.Join(fields, " ")))
+		if err != nil {
+			return nil, err
+		}
+		rule.rr = rr
+	case "remove":
+		t, err := dnsutil.StringToType(strings.ToUpper(fields[0]))
+		if err != nil {
+			// a parameter of HTTPS and SVCB records, such as ech
+			key := svcb.StringToKey(strings.ToLower(fields[0]))
+			if key == svcb.KeyReserved || key == svcb.KeyMandatory {
+				return nil, err
+			}
+			rule.key = key
+			break
+		}
+		rule.rType = t
+	case "ttl":
+		ttl, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		rule.ttl = uint32(ttl)
+	case "rcode":
+		rcode, err := dnsutil.StringToRcode(strings.ToUpper(fields[0]))
+		if err != nil {
+			return nil, err
+		}
+		rule.rcode = rcode
+	default:
+		return nil, fmt.Errorf("unknown action %s", rule.action)
+	}
+	return rule, nil
+}
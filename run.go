@@ -64,22 +64,66 @@ func run() (err error) {
 		backup = append(backup, defaultResolver)
 	}
 
+	svc.Debug("init client subnet")
+	initECS(*primarySubnet, *backupSubnet)
+	primary = withECS(primary, primaryECS)
+	backup = withECS(backup, backupECS)
+
 	svc.Debug("init exclude list")
 	exclude := initExcludeList(*exclude, primary, backup)
 	for _, i := range exclude {
 		svc.Debug("exclude", "domain", i)
 	}
 
+	svc.Debug("init cache")
+	initCache()
+
 	svc.Debug("init hosts")
-	initHosts(*hosts)
+	initHosts(*hosts, &currentHosts)
+
+	svc.Debug("init blocklist")
+	initDomainSet(*block, &currentBlock)
+
+	svc.Debug("init rewrite rules")
+	initRewrite(*rewrite, &currentRewrite)
+
+	svc.Debug("init DNS64")
+	initDNS64(*dns64, *dns64Prefix, *dns64Exclude)
+
+	svc.Debug("init address family rules")
+	initFamily(*family, *familyFile)
+
+	svc.Debug("init speed check")
+	initSpeedCheck(*speedCheck, *speedFastest, *speedTimeout)
+
+	svc.Debug("init views")
+	initViews(*viewsFile, primary, backup)
+
+	svc.Debug("init DNSSEC")
+	initDNSSEC(*dnssec, *anchors)
 
 	svc.Debug("init handle")
 	initHandle(primary, backup)
 	registerExclude(nil, exclude, primary, backup)
 
+	svc.Debug("init zones")
+	initTSIG(*tsig)
+	initTransfer(*transfer, *notifyList)
+	initZones(*zones)
+	initSecondary(*secondary)
+
+	svc.Debug("init ACL")
+	initACL(*allow, *deny, *trustedProxy)
+
+	svc.Debug("init rate limit")
+	initRateLimit(*rateLimit, *rateBurst, *rrl)
+	initCookie(*cookie, *cookieRotate)
+
+	handler := aclHandler{rateHandler{sizeHandler{cookieHandler{requestHandler{anyHandler{dns.DefaultServeMux}}}}}}
 	server := dns.NewServer()
 	server.Addr = addr
 	server.Net = network
+	server.Handler = handler
 	if *mode == "doh" {
 		svr := httpsvr.New()
 		svr.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -88,8 +132,20 @@ func run() (err error) {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			hw := dnshttp.NewResponseWriter(w, r, r.Context().Value(http.LocalAddrContextKey).(net.Addr))
-			dns.DefaultServeMux.ServeDNS(r.Context(), hw, m)
+			var hw dns.ResponseWriter = dnshttp.NewResponseWriter(w, r, r.Context().Value(http.LocalAddrContextKey).(net.Addr))
+			if ip, ok := dohClient(r); ok {
+				hw = &forwardedWriter{hw, &net.TCPAddr{IP: ip.AsSlice()}}
+			}
+			if *drop && !allowed(remoteAddr(hw)) {
+				svc.Debug("denied", "remote", remoteAddr(hw))
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			ctx := r.Context()
+			if token, ok := strings.CutPrefix(r.URL.Path, "/dns-query/"); ok && token != "" {
+				ctx = withToken(ctx, token)
+			}
+			handler.ServeDNS(ctx, hw, m)
 		})
 		if *unix != "" {
 			svr.Unix = *unix
@@ -129,7 +185,7 @@ func test() error {
 	done := make(chan struct{})
 
 	initHandle([]Client{defaultResolver}, nil)
-	initHosts(testHosts.Name())
+	initHosts(testHosts.Name(), &currentHosts)
 	go func() { ec <- dns.ListenAndServe(addr, "udp", dns.DefaultServeMux) }()
 
 	var query = func(q, expected string) error {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// secondaryRetry is the interval between attempts before the first transfer
+// of a secondary zone succeeds.
+const secondaryRetry = time.Minute
+
+// minRefresh is the lower bound of refresh and retry intervals taken from SOA.
+const minRefresh = 30 * time.Second
+
+// secondaryZone is a zone transferred from a primary server and served from
+// memory, see RFC 1034 section 4.3.5.
+type secondaryZone struct {
+	*zoneHandler
+	primary  string
+	key      string
+	notified chan struct{}
+	// checked is the last time the primary confirmed the zone is current.
+	checked time.Time
+}
+
+func (s *secondaryZone) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	switch r.Opcode {
+	case dns.OpcodeNotify:
+		s.handleNotify(w, r)
+		return
+	case dns.OpcodeUpdate:
+		// updates must be sent to the primary
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	s.zoneHandler.ServeDNS(ctx, w, r)
+}
+
+// handleNotify accepts NOTIFY from the primary and schedules an immediate
+// refresh, see RFC 1996.
+func (s *secondaryZone) handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	remote := remoteAddr(w)
+	if !s.isPrimary(remote) {
+		svc.Println("refuse NOTIFY", s.origin, "from", remote)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	svc.Debug("NOTIFY", "zone", s.origin, "from", remote)
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.Authoritative = true
+	m.WriteTo(w)
+	select {
+	case s.notified <- struct{}{}:
+	default:
+	}
+}
+
+func (s *secondaryZone) isPrimary(ip netip.Addr) bool {
+	host, _, _ := net.SplitHostPort(s.primary)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap() == ip
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		svc.Error("failed to lookup primary", "zone", s.origin, "primary", host, "error", err)
+		return false
+	}
+	for _, i := range addrs {
+		if i.Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// run keeps the zone in sync with the primary, refreshing when notified or when
+// the refresh timer fires.
+func (s *secondaryZone) run() {
+	for {
+		next := s.refresh()
+		svc.Debug("next refresh", "zone", s.origin, "after", next)
+		t := time.NewTimer(next)
+		select {
+		case <-t.C:
+		case <-s.notified:
+			t.Stop()
+		}
+	}
+}
+
+// refresh checks the serial of the primary and transfers the zone when it is
+// newer. It returns the interval until the next refresh.
+func (s *secondaryZone) refresh() time.Duration {
+	z := s.zone.Load()
+	serial, err := s.serial()
+	if err == nil && z != nil && dns.CompareSerial(serial, z.soa.Serial) <= 0 {
+		s.checked = time.Now()
+		return max(time.Duration(z.soa.Refresh)*time.Second, minRefresh)
+	}
+	if err == nil {
+		err = s.transfer(z)
+	}
+	if err == nil {
+		s.checked = time.Now()
+		return max(time.Duration(s.zone.Load().soa.Refresh)*time.Second, minRefresh)
+	}
+
+	svc.Error("failed to refresh secondary zone", "zone", s.origin, "primary", s.primary, "error", err)
+	if z == nil {
+		return secondaryRetry
+	}
+	if time.Since(s.checked) > time.Duration(z.soa.Expire)*time.Second {
+		svc.Println("secondary zone", s.origin, "expired")
+		s.zone.Store(nil)
+		return secondaryRetry
+	}
+	return max(time.Duration(z.soa.Retry)*time.Second, minRefresh)
+}
+
+// serial queries the SOA serial of the primary, over TCP like the transfer
+// itself.
+func (s *secondaryZone) serial() (uint32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	r, _, err := dns.NewClient().Exchange(ctx, dns.NewMsg(s.origin, dns.TypeSOA), "tcp", s.primary)
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, &rcodeError{r.Rcode}
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && dnsutil.Canonical(soa.Hdr.Name) == s.origin {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA record in answer")
+}
+
+// transfer transfers the zone from the primary, with IXFR when a version of
+// the zone is present.
+func (s *secondaryZone) transfer(z *zone) error {
+	qType := dns.TypeAXFR
+	if z != nil {
+		qType = dns.TypeIXFR
+	}
+	m := dns.NewMsg(s.origin, qType)
+	if z != nil {
+		m.Ns = []dns.RR{z.soa}
+	}
+	c := dns.NewClient()
+	if s.key != "" {
+		key := tsigKeys[s.key]
+		m.Pseudo = []dns.RR{dns.NewTSIG(s.key, key.algorithm, 300)}
+		c.Transfer = &dns.Transfer{TSIGSigner: key.HmacTSIG}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*(*timeout))
+	defer cancel()
+	env, err := c.TransferIn(ctx, m, "tcp", s.primary)
+	if err != nil {
+		return err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return e.Error
+		}
+		rrs = append(rrs, e.Answer...)
+	}
+
+	new, err := s.apply(z, rrs)
+	if err != nil || new == nil {
+		return err
+	}
+	svc.Println("transferred secondary zone", s.origin, "serial", new.soa.Serial, "type", dnsutil.TypeToString(qType))
+	if old := s.zone.Swap(new); old != nil {
+		s.changed(old, new)
+	}
+	return nil
+}
+
+// apply builds the new version of zone z from the records of an AXFR or IXFR
+// response. It returns nil when z is up to date.
+func (s *secondaryZone) apply(z *zone, rrs []dns.RR) (*zone, error) {
+	if len(rrs) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("transfer must start with SOA")
+	}
+	if len(rrs) == 1 {
+		if z != nil && dns.CompareSerial(soa.Serial, z.soa.Serial) <= 0 {
+			return nil, nil
+		}
+		return nil, errors.New("incomplete transfer")
+	}
+	if last, ok := rrs[len(rrs)-1].(*dns.SOA); !ok || last.Serial != soa.Serial {
+		return nil, errors.New("transfer must end with SOA")
+	}
+	if _, ok := rrs[1].(*dns.SOA); !ok || z == nil {
+		// AXFR, or IXFR answered with full zone
+		return newZone(s.origin, rrs[:len(rrs)-1])
+	}
+
+	// incremental: sequences of old SOA, deleted records, new SOA, added records
+	var diffs []*zoneDiff
+	var d *zoneDiff
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		switch soa, ok := rr.(*dns.SOA); {
+		case ok && (d == nil || d.to != nil):
+			d = &zoneDiff{from: soa}
+			diffs = append(diffs, d)
+		case ok:
+			d.to = soa
+		case d.to == nil:
+			d.del = append(d.del, rr)
+		default:
+			d.add = append(d.add, rr)
+		}
+	}
+	if d.to == nil || d.to.Serial != soa.Serial {
+		return nil, errors.New("incomplete IXFR")
+	}
+	return z.patch(diffs)
+}
+
+func initSecondary(s string) {
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		origin, primary, ok := strings.Cut(i, "=")
+		if !ok {
+			svc.Error("illegal secondary zone", "zone", i, "error", errors.New("secondary zone must be set as origin=primary[/key]"))
+			continue
+		}
+		primary, key, _ := strings.Cut(strings.TrimSpace(primary), "/")
+		if _, _, err := net.SplitHostPort(primary); err != nil {
+			primary = net.JoinHostPort(primary, "53")
+		}
+		if key != "" {
+			if key = dnsutil.Canonical(key); tsigKeys[key].Secret == nil {
+				svc.Error("unknown TSIG key", "zone", origin, "key", key)
+				continue
+			}
+		}
+		origin = dnsutil.Canonical(strings.TrimSpace(origin))
+		z := &secondaryZone{
+			zoneHandler: &zoneHandler{origin: origin, journal: new(journal)},
+			primary:     primary,
+			key:         key,
+			notified:    make(chan struct{}, 1),
+		}
+		svc.Debug("add secondary zone", "zone", origin, "primary", primary)
+		dns.DefaultServeMux.Handle(origin, z)
+		go z.run()
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/sunshineplan/utils/container"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// probeTTL is how long the latency measured of an address is reused.
+const probeTTL = 10 * time.Minute
+
+// speedChecker orders the addresses of answers by latency measured with its
+// probes, which are tried in turn until one reaches an address.
+type speedChecker struct {
+	probes  []string
+	fastest bool
+	timeout time.Duration
+	results container.Map[netip.Addr, *probeResult]
+}
+
+type probeResult struct {
+	rtt    time.Duration // zero for unreachable
+	expire time.Time
+}
+
+var currentSpeedCheck *speedChecker
+
+// parseSpeedCheck parses a list of probes, ping or tcp:port, separated with
+// commas.
+func parseSpeedCheck(s string) (probes []string, err error) {
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.ToLower(strings.TrimSpace(i)); i == "" {
+			continue
+		}
+		if i != "ping" {
+			port, ok := strings.CutPrefix(i, "tcp:")
+			if n, err := strconv.Atoi(port); !ok || err != nil || n < 1 || n > 65535 {
+				return nil, errors.New("unknown speed check " + i)
+			}
+		}
+		probes = append(probes, i)
+	}
+	return
+}
+
+func initSpeedCheck(s string, fastest bool, timeout time.Duration) {
+	probes, err := parseSpeedCheck(s)
+	if err != nil {
+		svc.Error("illegal speed check", "speed-check", s, "error", err)
+		return
+	}
+	if len(probes) == 0 {
+		return
+	}
+	svc.Debug("speed check", "probes", probes, "fastest", fastest, "timeout", timeout)
+	c := &speedChecker{probes: probes, fastest: fastest, timeout: timeout}
+	go func() {
+		for range time.Tick(time.Minute) {
+			c.sweep()
+		}
+	}()
+	currentSpeedCheck = c
+}
+
+func (c *speedChecker) sweep() {
+	now := time.Now()
+	c.results.Range(func(ip netip.Addr, r *probeResult) bool {
+		if now.After(r.expire) {
+			c.results.CompareAndDelete(ip, r)
+		}
+		return true
+	})
+}
+
+// latency returns the latency of ip, zero for unreachable.
+func (c *speedChecker) latency(ctx context.Context, ip netip.Addr) time.Duration {
+	if r, ok := c.results.Load(ip); ok && time.Now().Before(r.expire) {
+		return r.rtt
+	}
+	var rtt time.Duration
+	for _, probe := range c.probes {
+		var err error
+		if probe == "ping" {
+			rtt, err = c.ping(ctx, ip)
+		} else {
+			rtt, err = c.connect(ctx, ip, strings.TrimPrefix(probe, "tcp:"))
+		}
+		if err == nil {
+			break
+		}
+		svc.Debug("speed check failed", "address", ip, "probe", probe, "error", err)
+	}
+	c.results.Store(ip, &probeResult{rtt: rtt, expire: time.Now().Add(probeTTL)})
+	return rtt
+}
+
+func (c *speedChecker) connect(ctx context.Context, ip netip.Addr, port string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return max(rtt, 1), nil
+}
+
+// ping sends an ICMP echo to ip, with an unprivileged ping socket if allowed,
+// otherwise a raw socket.
+func (c *speedChecker) ping(ctx context.Context, ip netip.Addr) (time.Duration, error) {
+	network, raw, address := "udp4", "ip4:icmp", "0.0.0.0"
+	var typ, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := 1
+	if ip = ip.Unmap(); ip.Is6() {
+		network, raw, address = "udp6", "ip6:ipv6-icmp", "::"
+		typ, reply, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip.AsSlice()}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		if conn, err = icmp.ListenPacket(raw, address); err != nil {
+			return 0, err
+		}
+		dst = &net.IPAddr{IP: ip.AsSlice()}
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	// the kernel sets the ID of ping sockets, so replies are matched by
+	// sequence and data
+	id, seq := os.Getpid()&0xffff, int(time.Now().UnixNano()&0xffff)
+	data := []byte("dnshub")
+	b, err := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: seq, Data: data}}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || m.Type != reply {
+			continue
+		}
+		if echo, ok := m.Body.(*icmp.Echo); ok && echo.Seq == seq && string(echo.Data) == string(data) &&
+			peerAddr(peer) == ip {
+			return max(time.Since(start), 1), nil
+		}
+	}
+}
+
+func peerAddr(addr net.Addr) netip.Addr {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	}
+	a, _ := netip.AddrFromSlice(ip)
+	return a.Unmap()
+}
+
+// check orders the addresses answering r in m by latency, unreachable ones
+// last, or keeps only the fastest one. Answers with no reachable address are
+// left alone. lookup finds the SOA record of answers left empty.
+func (c *speedChecker) check(ctx context.Context, r, m *dns.Msg, lookup func(t uint16) (*dns.Msg, error)) *dns.Msg {
+	if c == nil || m.Rcode != dns.RcodeSuccess {
+		return m
+	}
+	t := dns.RRToType(r.Question[0])
+	if t != dns.TypeA && t != dns.TypeAAAA {
+		return m
+	}
+	var index []int
+	var addrs []netip.Addr
+	for i, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			index, addrs = append(index, i), append(addrs, rr.Addr)
+		case *dns.AAAA:
+			index, addrs = append(index, i), append(addrs, rr.Addr)
+		}
+	}
+	if len(addrs) < 2 {
+		return m
+	}
+	rtt := make([]time.Duration, len(addrs))
+	var wg sync.WaitGroup
+	for i, ip := range addrs {
+		wg.Go(func() { rtt[i] = c.latency(ctx, ip) })
+	}
+	wg.Wait()
+
+	order := make([]int, len(addrs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		switch {
+		case rtt[a] == rtt[b]:
+			return 0
+		case rtt[b] == 0:
+			return -1
+		case rtt[a] == 0:
+			return 1
+		}
+		return cmp.Compare(rtt[a], rtt[b])
+	})
+	if rtt[order[0]] == 0 {
+		return m
+	}
+	svc.Debug("speed check", "question", r.Question, "fastest", addrs[order[0]], "rtt", rtt[order[0]])
+	records := make([]dns.RR, len(index))
+	for i, j := range order {
+		records[i] = m.Answer[index[j]]
+	}
+	if c.fastest {
+		fastest := records[0]
+		m.Answer = slices.DeleteFunc(m.Answer, func(rr dns.RR) bool {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				return sig.TypeCovered == t
+			}
+			return dns.RRToType(rr) == t && rr != fastest
+		})
+		m.AuthenticatedData = false
+		withSOA(r, m, lookup)
+		return m
+	}
+	for i, j := range index {
+		m.Answer[j] = records[i]
+	}
+	return m
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/svcb"
+)
+
+// svcbOf returns the SVCB data of HTTPS and SVCB records.
+func svcbOf(rr dns.RR) *dns.SVCB {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	}
+	return nil
+}
+
+// removeParam returns rrs with the parameter key removed from HTTPS and SVCB
+// records, which are copied before modified, and whether any was changed.
+// Records listing the key as mandatory are dropped, as they are unusable
+// without it, see RFC 9460 section 8, and so are the RRSIG records covering
+// changed ones.
+func removeParam(rrs []dns.RR, key uint16) ([]dns.RR, bool) {
+	var res []dns.RR
+	var changed []uint16
+	for _, rr := range rrs {
+		s := svcbOf(rr)
+		if s == nil || !slices.ContainsFunc(s.Value, func(p svcb.Pair) bool { return svcb.PairToKey(p) == key }) {
+			res = append(res, rr)
+			continue
+		}
+		changed = append(changed, dns.RRToType(rr))
+		if slices.ContainsFunc(s.Value, func(p svcb.Pair) bool {
+			m, ok := p.(*svcb.MANDATORY)
+			return ok && slices.Contains(m.Key, key)
+		}) {
+			continue
+		}
+		rr = rr.Clone()
+		s = svcbOf(rr)
+		s.Value = slices.DeleteFunc(slices.Clone(s.Value), func(p svcb.Pair) bool { return svcb.PairToKey(p) == key })
+		res = append(res, rr)
+	}
+	if len(changed) == 0 {
+		return rrs, false
+	}
+	return slices.DeleteFunc(res, func(rr dns.RR) bool {
+		sig, ok := rr.(*dns.RRSIG)
+		return ok && slices.Contains(changed, sig.TypeCovered)
+	}), true
+}
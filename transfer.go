@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/sunshineplan/utils/retry"
+)
+
+// transferChunk is the number of records sent in each message of a zone
+// transfer.
+const transferChunk = 100
+
+var (
+	transferACL []netip.Prefix
+	secondaries []string
+)
+
+func initTransfer(acl, notify string) {
+	transferACL = parsePrefixes(acl)
+	for i := range strings.SplitSeq(notify, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(i); err != nil {
+			i = net.JoinHostPort(i, "53")
+		}
+		svc.Debug("notify", "secondary", i)
+		secondaries = append(secondaries, i)
+	}
+}
+
+// parsePrefixes parses a list of IP addresses or CIDR prefixes separated with
+// commas.
+func parsePrefixes(s string) (prefixes []netip.Prefix) {
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		if !strings.Contains(i, "/") {
+			ip, err := netip.ParseAddr(i)
+			if err != nil {
+				svc.Error("illegal IP address", "address", i, "error", err)
+				continue
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(i)
+		if err != nil {
+			svc.Error("illegal prefix", "prefix", i, "error", err)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, i := range prefixes {
+		if i.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the IP address of the remote side of w.
+func remoteAddr(w dns.ResponseWriter) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(w.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// transfer answers AXFR and IXFR requests of the zone, see RFC 5936 and
+// RFC 1995. Transfers are only allowed to addresses in transferACL, and must
+// be signed when TSIG keys are configured.
+func (h *zoneHandler) transfer(w dns.ResponseWriter, r *dns.Msg, z *zone) {
+	if err := r.Unpack(); err != nil {
+		svc.Debug("failed to unpack transfer request", "error", err)
+		writeRcode(w, r, dns.RcodeFormatError)
+		return
+	}
+	remote := remoteAddr(w)
+	if !containsAddr(transferACL, remote) {
+		svc.Println("refuse zone transfer", h.origin, "from", remote)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	key, err := verifyTSIG(r)
+	if err != nil || (key == nil && len(tsigKeys) > 0) {
+		svc.Println("refuse zone transfer without valid TSIG", h.origin, "from", remote, "error", err)
+		writeRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+
+	var rrs []dns.RR
+	switch dns.RRToType(r.Question[0]) {
+	case dns.TypeAXFR:
+		if isUDP(w) {
+			writeRcode(w, r, dns.RcodeRefused)
+			return
+		}
+		rrs = h.axfr(z)
+	case dns.TypeIXFR:
+		var soa *dns.SOA
+		if len(r.Ns) > 0 {
+			soa, _ = r.Ns[0].(*dns.SOA)
+		}
+		if soa == nil {
+			writeRcode(w, r, dns.RcodeFormatError)
+			return
+		}
+		switch diffs, ok := h.journal.since(soa.Serial); {
+		case dns.CompareSerial(soa.Serial, z.soa.Serial) >= 0, isUDP(w):
+			// up to date, or ask client to retry over TCP
+			rrs = []dns.RR{z.soa}
+		case ok:
+			rrs = append(rrs, z.soa)
+			for _, d := range diffs {
+				rrs = append(rrs, d.rrs()...)
+			}
+			rrs = append(rrs, z.soa)
+		default:
+			rrs = h.axfr(z)
+		}
+	}
+	svc.Println("zone transfer", h.origin, "serial", z.soa.Serial, "to", remote, "type", dnsutil.TypeToString(dns.RRToType(r.Question[0])))
+
+	env := make(chan *dns.Envelope, len(rrs)/transferChunk+1)
+	for i := 0; i < len(rrs); i += transferChunk {
+		env <- &dns.Envelope{Answer: rrs[i:min(i+transferChunk, len(rrs))]}
+	}
+	close(env)
+
+	c := dns.NewClient()
+	if key != nil {
+		c.Transfer = &dns.Transfer{TSIGSigner: key.HmacTSIG}
+	}
+	if !isUDP(w) {
+		w.Hijack()
+		defer w.Close()
+	}
+	if err := c.TransferOut(w, r, env); err != nil {
+		svc.Error("failed to transfer zone", "zone", h.origin, "error", err)
+	}
+}
+
+func (h *zoneHandler) axfr(z *zone) (rrs []dns.RR) {
+	rrs = append(rrs, z.soa)
+	rrs = append(rrs, z.all()...)
+	return append(rrs, z.soa)
+}
+
+// notify sends NOTIFY of the zone to secondaries, see RFC 1996.
+func notify(origin string, soa *dns.SOA) {
+	for _, addr := range secondaries {
+		m := dns.NewMsg(origin, dns.TypeSOA)
+		m.Opcode = dns.OpcodeNotify
+		m.Authoritative, m.RecursionDesired = true, false
+		m.Answer = []dns.RR{soa}
+		if err := retry.Do(func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			r, _, err := dns.NewClient().Exchange(ctx, m, "udp", addr)
+			if err != nil {
+				return err
+			}
+			if r.Rcode != dns.RcodeSuccess {
+				return &rcodeError{r.Rcode}
+			}
+			return nil
+		}, 3, 5*time.Second); err != nil {
+			svc.Error("failed to notify", "zone", origin, "secondary", addr, "error", err)
+			continue
+		}
+		svc.Debug("notified", "zone", origin, "secondary", addr, "serial", soa.Serial)
+	}
+}
+
+type rcodeError struct {
+	rcode uint16
+}
+
+func (e *rcodeError) Error() string {
+	return "rcode " + dnsutil.RcodeToString(e.rcode)
+}
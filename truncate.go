@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"codeberg.org/miekg/dns"
+)
+
+// sizeHandler truncates UDP responses larger than the client can receive,
+// which is 512 bytes without EDNS0, or its advertised buffer size capped by
+// -udp-size. Truncated responses carry only the question with the TC bit set
+// so that the client retries over TCP.
+type sizeHandler struct {
+	dns.Handler
+}
+
+func (h sizeHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	if !isUDP(w) || r.Unpack() != nil {
+		h.Handler.ServeDNS(ctx, w, r)
+		return
+	}
+	size := dns.MinMsgSize
+	if r.UDPSize > 0 {
+		size = max(dns.MinMsgSize, min(int(r.UDPSize), *udpSize))
+	}
+	h.Handler.ServeDNS(ctx, &udpWriter{w, func(p []byte) []byte {
+		if len(p) <= size {
+			return p
+		}
+		m := &dns.Msg{Data: p}
+		if err := m.Unpack(); err != nil {
+			return p
+		}
+		svc.Debug("truncate response", "remote", w.RemoteAddr(), "question", m.Question, "size", len(p), "max", size)
+		t := &dns.Msg{MsgHeader: m.MsgHeader, Question: m.Question, Pseudo: m.Pseudo}
+		t.Truncated = true
+		if err := t.Pack(); err != nil {
+			return p
+		}
+		return t.Data
+	}}, r)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+type tsigKey struct {
+	algorithm string
+	dns.HmacTSIG
+}
+
+// tsigKeys holds TSIG keys by canonical key name.
+var tsigKeys = make(map[string]tsigKey)
+
+// initTSIG parses TSIG keys set as [algorithm:]name:secret with base64 secret,
+// the algorithm defaults to hmac-sha256.
+func initTSIG(s string) {
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		elem := strings.Split(i, ":")
+		algorithm := dns.HmacSHA256
+		switch len(elem) {
+		case 2:
+		case 3:
+			algorithm = dnsutil.Fqdn(strings.ToLower(elem[0]))
+			elem = elem[1:]
+		default:
+			svc.Error("illegal TSIG key", "error", errors.New("TSIG key must be set as [algorithm:]name:secret"))
+			continue
+		}
+		secret, err := base64.StdEncoding.DecodeString(elem[1])
+		if err != nil {
+			svc.Error("illegal TSIG secret", "name", elem[0], "error", err)
+			continue
+		}
+		name := dnsutil.Canonical(elem[0])
+		svc.Debug("TSIG key", "name", name, "algorithm", algorithm)
+		tsigKeys[name] = tsigKey{algorithm, dns.HmacTSIG{Secret: secret}}
+	}
+}
+
+// getTSIG returns the TSIG record of m, m must be fully unpacked.
+func getTSIG(m *dns.Msg) *dns.TSIG {
+	if n := len(m.Pseudo); n > 0 {
+		t, _ := m.Pseudo[n-1].(*dns.TSIG)
+		return t
+	}
+	return nil
+}
+
+// verifyTSIG verifies the TSIG of r with the configured keys. It returns the
+// key when r is signed, and an error when the signature can not be verified.
+func verifyTSIG(r *dns.Msg) (*tsigKey, error) {
+	t := getTSIG(r)
+	if t == nil {
+		return nil, nil
+	}
+	key, ok := tsigKeys[dnsutil.Canonical(t.Hdr.Name)]
+	if !ok || key.algorithm != dnsutil.Canonical(t.Algorithm) {
+		return nil, dns.ErrKey
+	}
+	if err := dns.TSIGVerify(r, key.HmacTSIG, &dns.TSIGOption{}); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// signReply signs m, the reply to r, with key when r is signed.
+func signReply(m, r *dns.Msg, key *tsigKey) error {
+	t := getTSIG(r)
+	if key == nil || t == nil {
+		return nil
+	}
+	m.Pseudo = append(m.Pseudo, dns.NewTSIG(t.Hdr.Name, t.Algorithm, t.Fudge))
+	return dns.TSIGSign(m, key.HmacTSIG, &dns.TSIGOption{RequestMAC: t.MAC})
+}
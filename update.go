@@ -0,0 +1,215 @@
+package main
+
+import (
+	"slices"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// update applies a dynamic update to the zone, see RFC 2136. Updates must be
+// signed with one of the TSIG keys. Prerequisites are checked and updates are
+// applied as a whole, the change is recorded in the journal so that it
+// survives restarts.
+func (h *zoneHandler) update(w dns.ResponseWriter, r *dns.Msg) {
+	if err := r.Unpack(); err != nil {
+		svc.Debug("failed to unpack update", "error", err)
+		writeRcode(w, r, dns.RcodeFormatError)
+		return
+	}
+	remote := remoteAddr(w)
+	key, err := verifyTSIG(r)
+	if err != nil {
+		svc.Println("refuse update", h.origin, "from", remote, "error", err)
+		writeRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+	if key == nil {
+		svc.Println("refuse unsigned update", h.origin, "from", remote)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	if q := r.Question[0]; dns.RRToType(q) != dns.TypeSOA || dnsutil.Canonical(q.Header().Name) != h.origin {
+		m.Rcode = dns.RcodeNotZone
+	} else {
+		h.mu.Lock()
+		m.Rcode = h.apply(r)
+		h.mu.Unlock()
+	}
+	svc.Println("update", h.origin, "from", remote, "rcode", dnsutil.RcodeToString(m.Rcode))
+	if err := signReply(m, r, key); err != nil {
+		svc.Error("failed to sign update reply", "zone", h.origin, "error", err)
+		return
+	}
+	m.WriteTo(w)
+}
+
+// apply checks the prerequisites of r and applies its updates, it returns the
+// rcode of the reply. h.mu must be held.
+func (h *zoneHandler) apply(r *dns.Msg) uint16 {
+	z := h.zone.Load()
+	if rcode := z.prerequisite(r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := z.prescan(r.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	soa, records := z.soa, make(map[string][]dns.RR)
+	for name, rrs := range z.records {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.SOA); !ok {
+				records[name] = append(records[name], rr)
+			}
+		}
+	}
+	for _, rr := range r.Ns {
+		name := dnsutil.Canonical(rr.Header().Name)
+		t := dns.RRToType(rr)
+		switch rr.Header().Class {
+		case dns.ClassANY:
+			if t == dns.TypeANY {
+				if name == z.origin {
+					records[name] = filterType(records[name], dns.TypeNS)
+				} else {
+					delete(records, name)
+				}
+			} else if name != z.origin || (t != dns.TypeSOA && t != dns.TypeNS) {
+				records[name] = slices.DeleteFunc(records[name], func(i dns.RR) bool { return dns.RRToType(i) == t })
+			}
+		case dns.ClassNONE:
+			if t == dns.TypeSOA || (name == z.origin && t == dns.TypeNS && len(filterType(records[name], dns.TypeNS)) == 1) {
+				continue
+			}
+			key := rrKey(rr)
+			records[name] = slices.DeleteFunc(records[name], func(i dns.RR) bool { return rrKey(i) == key })
+		default:
+			if i, ok := rr.(*dns.SOA); ok {
+				if name == z.origin && dns.CompareSerial(i.Serial, soa.Serial) > 0 {
+					soa = i
+				}
+				continue
+			}
+			cname := filterType(records[name], dns.TypeCNAME)
+			if (t == dns.TypeCNAME && len(records[name]) > len(cname)) || (t != dns.TypeCNAME && len(cname) > 0) {
+				// CNAME can not coexist with other data
+				continue
+			}
+			key := rrKey(rr)
+			records[name] = slices.DeleteFunc(records[name], func(i dns.RR) bool {
+				return rrKey(i) == key || t == dns.TypeCNAME
+			})
+			records[name] = append(records[name], rr)
+		}
+	}
+
+	rrs := []dns.RR{soa}
+	for _, i := range records {
+		rrs = append(rrs, i...)
+	}
+	new, err := newZone(z.origin, rrs)
+	if err != nil {
+		svc.Error("failed to update zone", "zone", z.origin, "error", err)
+		return dns.RcodeServerFailure
+	}
+	if d := diffZone(z, new); len(d.del) == 0 && len(d.add) == 0 && soa == z.soa {
+		return dns.RcodeSuccess
+	}
+	if soa == z.soa {
+		soa = soa.Clone().(*dns.SOA)
+		soa.Serial++
+		rrs[0] = soa
+		if new, err = newZone(z.origin, rrs); err != nil {
+			svc.Error("failed to update zone", "zone", z.origin, "error", err)
+			return dns.RcodeServerFailure
+		}
+	}
+	h.zone.Store(new)
+	h.changed(z, new)
+	return dns.RcodeSuccess
+}
+
+// prerequisite checks the prerequisite section of an update, see RFC 2136
+// section 3.2.
+func (z *zone) prerequisite(rrs []dns.RR) uint16 {
+	rrsets := make(map[string]map[uint16][]string)
+	for _, rr := range rrs {
+		name := dnsutil.Canonical(rr.Header().Name)
+		if rr.Header().TTL != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dnsutil.IsBelow(z.origin, name) {
+			return dns.RcodeNotZone
+		}
+		t := dns.RRToType(rr)
+		switch rr.Header().Class {
+		case dns.ClassANY:
+			if t == dns.TypeANY {
+				if len(z.records[name]) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(filterType(z.records[name], t)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if t == dns.TypeANY {
+				if len(z.records[name]) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(filterType(z.records[name], t)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if rrsets[name] == nil {
+				rrsets[name] = make(map[uint16][]string)
+			}
+			rrsets[name][t] = append(rrsets[name][t], rrKey(rr))
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	// value dependent prerequisites must match whole RRsets
+	for name, types := range rrsets {
+		for t, keys := range types {
+			var have []string
+			for _, rr := range filterType(z.records[name], t) {
+				have = append(have, rrKey(rr))
+			}
+			slices.Sort(keys)
+			slices.Sort(have)
+			if !slices.Equal(slices.Compact(keys), have) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescan checks the update section of an update, see RFC 2136 section 3.4.1.
+func (z *zone) prescan(rrs []dns.RR) uint16 {
+	for _, rr := range rrs {
+		if !dnsutil.IsBelow(z.origin, dnsutil.Canonical(rr.Header().Name)) {
+			return dns.RcodeNotZone
+		}
+		t := dns.RRToType(rr)
+		if t == dns.TypeAXFR || t == dns.TypeIXFR {
+			return dns.RcodeFormatError
+		}
+		switch rr.Header().Class {
+		case dns.ClassINET:
+			if t == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY, dns.ClassNONE:
+			if rr.Header().TTL != 0 || (rr.Header().Class == dns.ClassNONE && t == dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
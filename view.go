@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"github.com/sunshineplan/utils/txt"
+)
+
+// view is a named group of clients with its own upstream DNS, exclude list,
+// blocklist, hosts and rewrite rules. Settings not set in a view are taken
+// from the global ones.
+type view struct {
+	name    string
+	clients []netip.Prefix
+	macs    []string
+	tokens  []string
+
+	primary []Client
+	backup  []Client
+	exclude *atomic.Pointer[domainSet]
+	block   *atomic.Pointer[domainSet]
+	hosts   *atomic.Pointer[hostsTable]
+	rewrite *atomic.Pointer[rewriteRules]
+
+	ecs, backupECS *ecsPolicy
+	dns64          *dns64Config
+}
+
+// defaultView is used for clients not in any view, with the global settings.
+var defaultView = &view{
+	block:   &currentBlock,
+	hosts:   &currentHosts,
+	rewrite: &currentRewrite,
+}
+
+var views []*view
+
+type tokenKey struct{}
+
+// withToken returns a context carrying the DoH token of a request.
+func withToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// clientView returns the first view the client of w belongs to, by source
+// address, MAC address or DoH token.
+func clientView(ctx context.Context, w dns.ResponseWriter) *view {
+	if len(views) == 0 {
+		return defaultView
+	}
+	ip := remoteAddr(w)
+	token, _ := ctx.Value(tokenKey{}).(string)
+	var mac string
+	for _, v := range views {
+		if containsAddr(v.clients, ip) {
+			return v
+		}
+		if token != "" && slices.Contains(v.tokens, token) {
+			return v
+		}
+		if len(v.macs) > 0 {
+			if mac == "" {
+				mac = lookupMAC(ip)
+			}
+			if mac != "" && slices.Contains(v.macs, mac) {
+				return v
+			}
+		}
+	}
+	return defaultView
+}
+
+// cacheKey returns the cache key of question in the view, views do not share
+// cached answers as they may use different upstream DNS.
+func (v *view) cacheKey(question []dns.RR) string {
+	if v.name == "" {
+		return fmt.Sprint(question)
+	}
+	return v.name + ":" + fmt.Sprint(question)
+}
+
+// initViews parses the views file, one section for each view:
+//
+//	[name]
+//	clients = 192.168.20.0/24, aa:bb:cc:dd:ee:ff, token:secret
+//	primary = ...
+//	backup  = ...
+//	ecs     = client/24/56
+//	backup-ecs = strip
+//	dns64   = on, off or prefix
+//	dns64-exclude = prefixes
+//	exclude = file
+//	block   = file
+//	hosts   = files
+//	rewrite = file
+func initViews(file string, primary, backup []Client) {
+	if file == "" {
+		return
+	}
+	rows, err := txt.ReadFile(file)
+	if err != nil {
+		svc.Error("failed to load views file", "error", err)
+		return
+	}
+	var v *view
+	for line, i := range rows {
+		if n := strings.IndexRune(i, '#'); n != -1 {
+			i = i[:n]
+		}
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(i, "["); ok {
+			v = &view{
+				name:      strings.TrimSpace(strings.TrimSuffix(name, "]")),
+				primary:   primary,
+				backup:    backup,
+				ecs:       primaryECS,
+				backupECS: backupECS,
+				dns64:     currentDNS64,
+				block:     &currentBlock,
+				hosts:     &currentHosts,
+				rewrite:   &currentRewrite,
+			}
+			svc.Debug("add view", "name", v.name)
+			views = append(views, v)
+			continue
+		}
+		key, value, ok := strings.Cut(i, "=")
+		if !ok || v == nil {
+			svc.Error("illegal views row", "file", file, "line", line+1, "row", i)
+			continue
+		}
+		if err := v.set(strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)); err != nil {
+			svc.Error("illegal views row", "file", file, "line", line+1, "row", i, "error", err)
+		}
+	}
+	for _, v := range views {
+		v.primary = withECS(v.primary, v.ecs)
+		v.backup = withECS(v.backup, v.backupECS)
+	}
+}
+
+func (v *view) set(key, value string) error {
+	switch key {
+	case "clients":
+		for i := range strings.SplitSeq(value, ",") {
+			if i = strings.TrimSpace(i); i == "" {
+				continue
+			}
+			if token, ok := strings.CutPrefix(i, "token:"); ok {
+				v.tokens = append(v.tokens, token)
+			} else if mac, err := net.ParseMAC(i); err == nil {
+				v.macs = append(v.macs, mac.String())
+			} else {
+				v.clients = append(v.clients, parsePrefixes(i)...)
+			}
+		}
+	case "primary":
+		v.primary = parseClients(value)
+	case "backup":
+		v.backup = parseClients(value)
+	case "ecs":
+		policy, err := parseECS(value)
+		if err != nil {
+			return err
+		}
+		v.ecs = policy
+	case "backup-ecs":
+		policy, err := parseECS(value)
+		if err != nil {
+			return err
+		}
+		v.backupECS = policy
+	case "dns64":
+		switch strings.ToLower(value) {
+		case "off", "false":
+			v.dns64 = nil
+		case "on", "true":
+			c, err := parseDNS64(*dns64Prefix, *dns64Exclude)
+			if err != nil {
+				return err
+			}
+			v.dns64 = c
+		default:
+			c, err := parseDNS64(value, *dns64Exclude)
+			if err != nil {
+				return err
+			}
+			v.dns64 = c
+		}
+	case "dns64-exclude":
+		if v.dns64 == nil {
+			return errors.New("DNS64 is not enabled")
+		}
+		v.dns64 = &dns64Config{prefix: v.dns64.prefix, exclude: parsePrefixes(value)}
+	case "exclude":
+		v.exclude = new(atomic.Pointer[domainSet])
+		initDomainSet(value, v.exclude)
+	case "block":
+		v.block = new(atomic.Pointer[domainSet])
+		initDomainSet(value, v.block)
+	case "hosts":
+		v.hosts = new(atomic.Pointer[hostsTable])
+		initHosts(value, v.hosts)
+	case "rewrite":
+		v.rewrite = new(atomic.Pointer[rewriteRules])
+		initRewrite(value, v.rewrite)
+	default:
+		return errors.New("unknown key " + key)
+	}
+	return nil
+}
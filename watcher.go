@@ -1,7 +1,11 @@
 package main
 
 import (
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"codeberg.org/miekg/dns"
 	"codeberg.org/miekg/dns/dnsutil"
@@ -10,7 +14,7 @@ import (
 )
 
 func initExcludeList(file string, primary, backup []Client) []string {
-	exclude, err := txt.ReadFile(file)
+	exclude, err := readExcludeList(file)
 	if err != nil {
 		svc.Error("failed to load exclude list file", "error", err)
 	}
@@ -41,20 +45,20 @@ func initExcludeList(file string, primary, backup []Client) []string {
 					svc.Println(file, "operation:", event.Op)
 					switch {
 					case event.Has(fsnotify.Create), event.Has(fsnotify.Write):
-						s, err := txt.ReadFile(file)
+						s, err := readExcludeList(file)
 						if err != nil {
 							svc.Error("failed to load exclude list file", "error", err)
 						} else {
 							registerExclude(exclude, s, primary, backup)
+							invalidateCache(changedPatterns(exclude, s))
 							exclude = s
 						}
-						dnsCache.Clear()
 					case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
 						for _, i := range exclude {
 							dns.DefaultServeMux.HandleRemove(dnsutil.Fqdn(i))
 						}
+						invalidateCache(exclude)
 						exclude = nil
-						dnsCache.Clear()
 					}
 				}
 			}
@@ -63,3 +67,95 @@ func initExcludeList(file string, primary, backup []Client) []string {
 
 	return exclude
 }
+
+// debounceDelay is how long watchPaths waits for changes to settle.
+const debounceDelay = 500 * time.Millisecond
+
+// watchPaths watches the given files and directories, files in directories
+// are only considered when they have the given extension. The parent
+// directories of files are watched, so editors which replace files by rename
+// are handled. fn is called once changes settle for debounceDelay.
+func watchPaths(paths []string, ext string, fn func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, i := range paths {
+		path, err := filepath.Abs(i)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		dir := filepath.Dir(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dirs[path] = true
+			dir = path
+		} else {
+			files[path] = true
+		}
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				svc.Error("watch error", "error", err)
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) ||
+					!files[event.Name] && !(dirs[filepath.Dir(event.Name)] && filepath.Ext(event.Name) == ext) {
+					continue
+				}
+				svc.Debug("watch", "file", event.Name, "operation", event.Op)
+				if timer == nil {
+					timer = time.AfterFunc(debounceDelay, fn)
+				} else {
+					timer.Reset(debounceDelay)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func readExcludeList(file string) (exclude []string, err error) {
+	rows, err := txt.ReadFile(file)
+	if err != nil {
+		return
+	}
+	for _, i := range rows {
+		if i = strings.TrimSpace(i); i != "" && !strings.HasPrefix(i, "#") {
+			exclude = append(exclude, i)
+		}
+	}
+	return
+}
+
+// changedPatterns returns the patterns which are only in one of old and new.
+func changedPatterns(old, new []string) (changed []string) {
+	for _, i := range old {
+		if !slices.Contains(new, i) {
+			changed = append(changed, i)
+		}
+	}
+	for _, i := range new {
+		if !slices.Contains(old, i) {
+			changed = append(changed, i)
+		}
+	}
+	return
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+// maxCNAME is the maximum length of an in-zone CNAME chain.
+const maxCNAME = 8
+
+// zone is an authoritative zone. Records are keyed by canonical owner name,
+// empty non-terminals are present with no records.
+type zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+}
+
+func newZone(origin string, rrs []dns.RR) (*zone, error) {
+	z := &zone{origin: dnsutil.Canonical(origin), records: make(map[string][]dns.RR)}
+	for _, rr := range rrs {
+		name := dnsutil.Canonical(rr.Header().Name)
+		if !dnsutil.IsBelow(z.origin, name) {
+			svc.Error("ignore out of zone record", "zone", z.origin, "record", rr)
+			continue
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			if name != z.origin {
+				svc.Error("ignore SOA record not at zone apex", "zone", z.origin, "record", rr)
+				continue
+			}
+			if z.soa != nil {
+				continue
+			}
+			z.soa = soa
+		}
+		z.records[name] = append(z.records[name], rr)
+		for off, end := dnsutil.Next(name, 0); !end; off, end = dnsutil.Next(name, off) {
+			parent := name[off:]
+			if !dnsutil.IsBelow(z.origin, parent) {
+				break
+			}
+			if _, ok := z.records[parent]; !ok {
+				z.records[parent] = nil
+			}
+		}
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", z.origin)
+	}
+	return z, nil
+}
+
+func loadZone(origin, file string) (*zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(f, dnsutil.Fqdn(origin), file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return newZone(origin, rrs)
+}
+
+// negative returns the SOA record for negative answers, see RFC 2308.
+func (z *zone) negative() dns.RR {
+	soa := z.soa.Clone().(*dns.SOA)
+	soa.Hdr.TTL = min(soa.Hdr.TTL, soa.Minttl)
+	return soa
+}
+
+// delegation returns the NS records of the zone cut at or above name, if any.
+func (z *zone) delegation(name string) (cut string, ns []dns.RR) {
+	for off, end := 0, false; !end; off, end = dnsutil.Next(name, off) {
+		parent := name[off:]
+		if parent == z.origin || !dnsutil.IsBelow(z.origin, parent) {
+			break
+		}
+		if rrs := filterType(z.records[parent], dns.TypeNS); len(rrs) > 0 {
+			cut, ns = parent, rrs
+		}
+	}
+	return
+}
+
+// wildcard returns the records of the wildcard at the closest encloser of
+// name, with owner name replaced by name.
+func (z *zone) wildcard(name string) ([]dns.RR, bool) {
+	for off, end := dnsutil.Next(name, 0); !end; off, end = dnsutil.Next(name, off) {
+		encloser := name[off:]
+		if _, ok := z.records[encloser]; !ok {
+			continue
+		}
+		rrs, ok := z.records["*."+encloser]
+		if !ok {
+			return nil, false
+		}
+		synthesized := make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			synthesized[i] = rr.Clone()
+			synthesized[i].Header().Name = name
+		}
+		return synthesized, true
+	}
+	return nil, false
+}
+
+// additional returns the in-zone addresses of the targets in rrs.
+func (z *zone) additional(rrs []dns.RR) (extra []dns.RR) {
+	for _, rr := range rrs {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		for _, i := range z.records[dnsutil.Canonical(target)] {
+			if t := dns.RRToType(i); t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, i)
+			}
+		}
+	}
+	return
+}
+
+// answer answers r from zone data, following in-zone CNAME chains.
+func (z *zone) answer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, r)
+	m.Authoritative, m.RecursionAvailable = true, true
+
+	qType := dns.RRToType(r.Question[0])
+	name := r.Question[0].Header().Name
+	visited := make(map[string]bool)
+	for range maxCNAME {
+		canonical := dnsutil.Canonical(name)
+		if visited[canonical] {
+			svc.Debug("CNAME loop", "zone", z.origin, "question", r.Question)
+			return m
+		}
+		visited[canonical] = true
+		if cut, ns := z.delegation(canonical); ns != nil && !(qType == dns.TypeDS && cut == canonical) {
+			if len(m.Answer) == 0 {
+				m.Authoritative = false
+			}
+			m.Ns = ns
+			m.Extra = z.additional(ns)
+			return m
+		}
+
+		rrs, ok := z.records[canonical]
+		if !ok {
+			if rrs, ok = z.wildcard(canonical); !ok {
+				m.Rcode = dns.RcodeNameError
+				m.Ns = []dns.RR{z.negative()}
+				return m
+			}
+		}
+		if answer := filterType(rrs, qType); len(answer) > 0 {
+			m.Answer = append(m.Answer, answer...)
+			m.Extra = z.additional(answer)
+			return m
+		}
+		cname := filterType(rrs, dns.TypeCNAME)
+		if len(cname) == 0 {
+			m.Ns = []dns.RR{z.negative()}
+			return m
+		}
+		m.Answer = append(m.Answer, cname[0])
+		name = cname[0].(*dns.CNAME).Target
+		if !dnsutil.IsBelow(z.origin, dnsutil.Canonical(name)) {
+			return m
+		}
+	}
+	svc.Debug("CNAME chain too long", "zone", z.origin, "question", r.Question)
+	return m
+}
+
+// all returns all records of the zone except the SOA record, in canonical
+// order.
+func (z *zone) all() (rrs []dns.RR) {
+	for _, i := range z.records {
+		for _, rr := range i {
+			if _, ok := rr.(*dns.SOA); !ok {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	slices.SortFunc(rrs, dns.Compare)
+	return
+}
+
+// filterType returns the records of type t in rrs, all records for ANY.
+func filterType(rrs []dns.RR, t uint16) (res []dns.RR) {
+	for _, rr := range rrs {
+		if t == dns.TypeANY || dns.RRToType(rr) == t {
+			res = append(res, rr)
+		}
+	}
+	return
+}
+
+type zoneHandler struct {
+	origin  string
+	file    string
+	zone    atomic.Pointer[zone]
+	journal *journal
+	// mu serializes changes of the zone.
+	mu sync.Mutex
+}
+
+func newZoneHandler(origin, file string) (*zoneHandler, error) {
+	h := &zoneHandler{origin: origin, file: file}
+	z, err := loadZone(origin, file)
+	if err != nil {
+		return nil, err
+	}
+	if h.journal, err = loadJournal(file + ".jnl"); err != nil {
+		svc.Error("failed to load journal", "zone", origin, "error", err)
+	}
+	if serial, ok := h.journal.last(); ok && serial != z.soa.Serial {
+		if z = h.replay(z); z.soa.Serial != serial {
+			svc.Debug("discard outdated journal", "zone", origin, "serial", serial)
+			h.journal.reset()
+		}
+	}
+	h.zone.Store(z)
+	return h, nil
+}
+
+// replay applies the changes recorded in the journal after the version of z,
+// such as dynamic updates, to z.
+func (h *zoneHandler) replay(z *zone) *zone {
+	diffs, ok := h.journal.since(z.soa.Serial)
+	if !ok {
+		return z
+	}
+	patched, err := z.patch(diffs)
+	if err != nil {
+		svc.Error("failed to replay journal", "zone", h.origin, "error", err)
+		return z
+	}
+	svc.Debug("replay journal", "zone", h.origin, "from", z.soa.Serial, "to", patched.soa.Serial)
+	return patched
+}
+
+func (h *zoneHandler) reload() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	z, err := loadZone(h.origin, h.file)
+	if err != nil {
+		svc.Error("failed to reload zone", "zone", h.origin, "error", err)
+		return
+	}
+	z = h.replay(z)
+	svc.Println("reload zone", h.origin, "serial", z.soa.Serial)
+	h.changed(h.zone.Swap(z), z)
+}
+
+// changed records the difference between versions in the journal for IXFR
+// and notifies secondaries.
+func (h *zoneHandler) changed(old, new *zone) {
+	d := diffZone(old, new)
+	switch dns.CompareSerial(new.soa.Serial, old.soa.Serial) {
+	case 0:
+		if len(d.del) == 0 && len(d.add) == 0 {
+			return
+		}
+		svc.Println("zone", h.origin, "changed without serial increased")
+		if err := h.journal.reset(); err != nil {
+			svc.Error("failed to reset journal", "zone", h.origin, "error", err)
+		}
+		return
+	case -1:
+		svc.Println("zone", h.origin, "serial decreased")
+		if err := h.journal.reset(); err != nil {
+			svc.Error("failed to reset journal", "zone", h.origin, "error", err)
+		}
+	default:
+		if err := h.journal.append(d); err != nil {
+			svc.Error("failed to save journal", "zone", h.origin, "error", err)
+		}
+	}
+	go notify(h.origin, new.soa)
+}
+
+func (h *zoneHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	svc.Debug("request zone", "zone", h.origin, "remote", w.RemoteAddr(), "id", r.ID, "question", r.Question)
+	if r.Question[0].Header().Class != dns.ClassINET {
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	z := h.zone.Load()
+	if z == nil {
+		// secondary zone not transferred yet or expired
+		writeRcode(w, r, dns.RcodeServerFailure)
+		return
+	}
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		h.update(w, r)
+		return
+	case dns.OpcodeNotify:
+		// only secondary zones accept NOTIFY
+		writeRcode(w, r, dns.RcodeNotImplemented)
+		return
+	}
+	switch dns.RRToType(r.Question[0]) {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		h.transfer(w, r, z)
+	default:
+		z.answer(r).WriteTo(w)
+	}
+}
+
+func initZones(s string) {
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		origin, file, ok := strings.Cut(i, "=")
+		if !ok {
+			svc.Error("illegal zone", "zone", i, "error", errors.New("zone must be set as origin=file"))
+			continue
+		}
+		origin, file = dnsutil.Canonical(strings.TrimSpace(origin)), strings.TrimSpace(file)
+		h, err := newZoneHandler(origin, file)
+		if err != nil {
+			svc.Error("failed to load zone", "zone", origin, "error", err)
+			continue
+		}
+		svc.Debug("add zone", "zone", origin, "file", file, "serial", h.zone.Load().soa.Serial)
+		dns.DefaultServeMux.Handle(origin, h)
+
+		if err := watchPaths([]string{file}, "", h.reload); err != nil {
+			svc.Error("failed to watch zone file", "zone", origin, "error", err)
+		}
+	}
+}